@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Timestamp written by the header, see bundler.DefaultHeaderTemplate
+var headerTime = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})`)
+
+// Written for the time in the header of the bundle compared by checkOutput, so that only
+// the time of the header is ignored and not timestamps elsewhere in the bundle
+const timePlaceholder = "\x00time\x00"
+
+// Number of unchanged lines shown around the changes of a diff
+const diffContext = 3
+
+// Compare the bundle to the existing output file without writing it, printing a unified
+// diff and failing when they differ. The bundle has timePlaceholder for the time in its
+// header, which matches any time in the output as it changes on every build, a missing
+// output is compared as empty
+func checkOutput(output string, newSource []byte) error {
+	oldSource, err := os.ReadFile(output)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	before, after, found := bytes.Cut(newSource, []byte(timePlaceholder))
+	if !found {
+		if bytes.Equal(oldSource, newSource) {
+			return nil
+		}
+	} else {
+		timestamp, ok := oldTime(oldSource, before)
+		if ok && bytes.Equal(oldSource[len(before)+len(timestamp):], after) {
+			return nil
+		}
+
+		// show the time of the output in the diff so only actual changes stand out
+		if !ok {
+			timestamp = []byte(time.Now().Format(time.RFC3339))
+		}
+		newSource = slices.Concat(before, timestamp, after)
+	}
+
+	fmt.Print(unifiedDiff(output, output+" (bundled)", oldSource, newSource))
+
+	return fmt.Errorf("%s is not up to date with its inputs", output)
+}
+
+// Get the time in the header of the old source, where the new one has the placeholder
+// following the same text before it
+func oldTime(oldSource, before []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(oldSource, before) {
+		return nil, false
+	}
+
+	timestamp := headerTime.Find(oldSource[len(before):])
+
+	return timestamp, timestamp != nil
+}
+
+// A line of a diff, op is ' ' for an unchanged line, '-' for a removed one and '+' for an
+// added one
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// Split the text into lines keeping their newline, the last one may have none
+func splitLines(text []byte) []string {
+	lines := strings.SplitAfter(string(text), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
+
+// Diff the lines from their longest common subsequence, after skipping the common prefix
+// and suffix so that the table stays small for the usual few changes
+func diffLines(a, b []string) []diffLine {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+
+	x, y := a[pre:len(a)-suf], b[pre:len(b)-suf]
+
+	// lcs[i][j] is the length of the longest common subsequence of x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var lines []diffLine
+	for _, text := range a[:pre] {
+		lines = append(lines, diffLine{' ', text})
+	}
+
+	for i, j := 0, 0; i < len(x) || j < len(y); {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			lines = append(lines, diffLine{' ', x[i]})
+			i, j = i+1, j+1
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, diffLine{'-', x[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', y[j]})
+			j++
+		}
+	}
+
+	for _, text := range a[len(a)-suf:] {
+		lines = append(lines, diffLine{' ', text})
+	}
+
+	return lines
+}
+
+// Format the changes from a to b as a unified diff
+func unifiedDiff(aName, bName string, a, b []byte) string {
+	lines := diffLines(splitLines(a), splitLines(b))
+	changed := func(i int) bool { return lines[i].op != ' ' }
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", aName, bName)
+
+	// aLine and bLine count the lines of a and b before lines[start]
+	aLine, bLine := 0, 0
+	count := func(lines []diffLine) (n, m int) {
+		for _, line := range lines {
+			if line.op != '+' {
+				n++
+			}
+			if line.op != '-' {
+				m++
+			}
+		}
+		return n, m
+	}
+
+	for start := 0; start < len(lines); {
+		first := start
+		for first < len(lines) && !changed(first) {
+			first++
+		}
+		if first == len(lines) {
+			break
+		}
+
+		// merge the following changes separated by less than twice the context
+		end := first + 1
+		for next := end; next < len(lines) && next-end < 2*diffContext; next++ {
+			if changed(next) {
+				end = next + 1
+			}
+		}
+
+		begin := max(first-diffContext, start)
+		end = min(end+diffContext, len(lines))
+
+		n, m := count(lines[start:begin])
+		aLine, bLine = aLine+n, bLine+m
+		n, m = count(lines[begin:end])
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n", hunkRange(aLine, n), hunkRange(bLine, m))
+
+		for _, line := range lines[begin:end] {
+			buf.WriteByte(line.op)
+			buf.WriteString(line.text)
+			if !strings.HasSuffix(line.text, "\n") {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		aLine, bLine = aLine+n, bLine+m
+		start = end
+	}
+
+	return buf.String()
+}
+
+// Format the range of a hunk starting after the given number of lines
+func hunkRange(before, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	if n == 1 {
+		return fmt.Sprintf("%d", before+1)
+	}
+
+	return fmt.Sprintf("%d,%d", before+1, n)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nr8-io/jsonnet-bundler/pkg/bundler"
+)
+
+// Get the lines 1 to n, each replaced by its entry in changes if it has one
+func numbered(n int, changes map[int]string) []byte {
+	var b strings.Builder
+	for i := 1; i <= n; i++ {
+		if line, ok := changes[i]; ok {
+			b.WriteString(line + "\n")
+		} else {
+			fmt.Fprintf(&b, "%d\n", i)
+		}
+	}
+
+	return []byte(b.String())
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []byte
+		want string
+	}{
+		{"equal", numbered(3, nil), numbered(3, nil), ""},
+		{"one change", numbered(10, nil), numbered(10, map[int]string{5: "five"}),
+			"@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n"},
+		{"separate hunks", numbered(20, nil), numbered(20, map[int]string{2: "two", 18: "eighteen"}),
+			"@@ -1,5 +1,5 @@\n 1\n-2\n+two\n 3\n 4\n 5\n@@ -15,6 +15,6 @@\n 15\n 16\n 17\n-18\n+eighteen\n 19\n 20\n"},
+		{"merged hunks", numbered(20, nil), numbered(20, map[int]string{2: "two", 8: "eight"}),
+			"@@ -1,11 +1,11 @@\n 1\n-2\n+two\n 3\n 4\n 5\n 6\n 7\n-8\n+eight\n 9\n 10\n 11\n"},
+		{"from empty", nil, []byte("x\ny\n"), "@@ -0,0 +1,2 @@\n+x\n+y\n"},
+		{"to empty", []byte("x\n"), nil, "@@ -1 +0,0 @@\n-x\n"},
+		{"no final newline", []byte("a\nb"), []byte("a\nc"),
+			"@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n\\ No newline at end of file\n"},
+	}
+
+	for _, tt := range tests {
+		want := "--- a.libsonnet\n+++ b.libsonnet\n" + tt.want
+		if got := unifiedDiff("a.libsonnet", "b.libsonnet", tt.a, tt.b); got != want {
+			t.Errorf("%s: diff\n%s\nwant\n%s", tt.name, got, want)
+		}
+	}
+}
+
+// Only the time in the header is ignored, a timestamp changed in the body is a difference
+func TestCheckOutputTime(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "main.jsonnet")
+	output := filepath.Join(dir, "out.jsonnet")
+
+	bundle := func(source string, opts bundler.Options) []byte {
+		t.Helper()
+
+		if err := os.WriteFile(input, []byte(source), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		out, err := bundler.BundleFiles([]string{input}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return out
+	}
+
+	source := "local built = '2024-01-01T00:00:00Z';\n{ built: built }\n"
+	changed := strings.Replace(source, "2024", "2025", 1)
+
+	// the first timestamp of the bundle is in the body when the header has no time
+	for _, tmpl := range []string{"", "// Bundled from {{.Source}}"} {
+		written := bundle(source, bundler.Options{Header: true, HeaderTemplate: tmpl})
+		if err := os.WriteFile(output, written, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		check := bundler.Options{Header: true, HeaderTemplate: tmpl, HeaderTime: timePlaceholder}
+		if err := checkOutput(output, bundle(source, check)); err != nil {
+			t.Errorf("template %q: unchanged bundle: %v", tmpl, err)
+		}
+		if err := checkOutput(output, bundle(changed, check)); err == nil {
+			t.Errorf("template %q: bundle with a changed timestamp in the body: no error", tmpl)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"slices"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Configuration files looked up in the working directory when --config isn't given
+var defaultConfigs = []string{".jsonnet-bundler.yaml", ".jsonnet-bundler.json"}
+
+// Read the configuration file and set the flags it has that weren't given on the command
+// line, returning its inputs. The file is a YAML or JSON object of flag names, without
+// dashes, to their values, a list for repeatable flags and an object for key=value ones,
+// plus "inputs" for the input files. A missing default configuration file is no error
+func readConfig(flags *flag.FlagSet, path string) ([]string, error) {
+	explicit := path != ""
+	paths := []string{path}
+	if !explicit {
+		paths = defaultConfigs
+	}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if !explicit && errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		inputs, err := applyConfig(flags, data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config %s: %w", path, err)
+		}
+
+		return inputs, nil
+	}
+
+	return nil, nil
+}
+
+// Set the flags of the configuration, flags given on the command line take precedence
+// over the file including every alias of them, e.g. -o over output
+func applyConfig(flags *flag.FlagSet, data []byte) ([]string, error) {
+	var config map[string]any
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	var given []flag.Value
+	flags.Visit(func(f *flag.Flag) { given = append(given, f.Value) })
+
+	var inputs []string
+	for _, name := range slices.Sorted(maps.Keys(config)) {
+		value := config[name]
+
+		if name == "inputs" {
+			list, ok := value.([]any)
+			if !ok {
+				return nil, fmt.Errorf("inputs must be a list of files")
+			}
+			for _, item := range list {
+				inputs = append(inputs, fmt.Sprint(item))
+			}
+			continue
+		}
+
+		f := flags.Lookup(name)
+		if f == nil || name == "config" {
+			return nil, fmt.Errorf("unknown flag %q", name)
+		}
+		if slices.Contains(given, f.Value) {
+			continue
+		}
+
+		for _, v := range configValues(value) {
+			if err := f.Value.Set(v); err != nil {
+				return nil, fmt.Errorf("invalid value %q for flag %s: %w", v, name, err)
+			}
+		}
+	}
+
+	return inputs, nil
+}
+
+// Get the flag values of a configuration value, one for each item of a list and a
+// key=value pair for each field of an object, sorted by key
+func configValues(value any) []string {
+	switch v := value.(type) {
+	case []any:
+		var values []string
+		for _, item := range v {
+			values = append(values, fmt.Sprint(item))
+		}
+		return values
+	case map[string]any:
+		var values []string
+		for _, key := range slices.Sorted(maps.Keys(v)) {
+			values = append(values, key+"="+fmt.Sprint(v[key]))
+		}
+		return values
+	case nil:
+		return nil
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
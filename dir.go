@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Patterns of the files bundled from a directory when no --include is given
+var defaultIncludes = []string{"*.libsonnet", "*.jsonnet"}
+
+// Find the files to bundle in the directory tree, sorted by path, and the directories of
+// the tree that weren't skipped. A pattern containing a separator is matched against the
+// path relative to dir, otherwise against the base name, and an excluded directory is
+// skipped entirely. With gitignore, the paths ignored by the .gitignore files of the tree
+// are excluded as well
+func dirInputs(dir string, includes []string, excludes []string, gitignore bool) ([]string, []string, error) {
+	if len(includes) == 0 {
+		includes = defaultIncludes
+	}
+
+	ignores := make(gitignores)
+
+	var inputs, dirs []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		excluded := false
+		if rel != "." {
+			excluded, err = matchAny(excludes, rel)
+			if err != nil {
+				return err
+			}
+			excluded = excluded || gitignore && ignores.ignored(rel, d.IsDir())
+		}
+
+		// the rules of a directory only apply inside of it, there is no need to read
+		// them for a directory that is skipped
+		if gitignore && d.IsDir() && !excluded {
+			if err := ignores.read(dir, rel); err != nil {
+				return err
+			}
+		}
+		if d.IsDir() {
+			if excluded {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, path)
+			return nil
+		}
+
+		included, err := matchAny(includes, rel)
+		if err != nil {
+			return err
+		}
+
+		if included && !excluded {
+			inputs = append(inputs, path)
+		}
+
+		return nil
+	})
+
+	slices.Sort(inputs)
+
+	return inputs, dirs, err
+}
+
+// Check whether the relative path matches any of the glob patterns
+func matchAny(patterns []string, rel string) (bool, error) {
+	for _, pattern := range patterns {
+		name := rel
+		if !strings.ContainsRune(pattern, '/') {
+			name = filepath.Base(rel)
+		}
+
+		ok, err := filepath.Match(filepath.FromSlash(pattern), name)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Get the path of the copy of the input written under --out-dir, relative to the --dir
+// tree when the input is in it or else to the working directory
+func outDirPath(input string, dir string) (string, error) {
+	for _, root := range []string{dir, "."} {
+		if root == "" {
+			continue
+		}
+
+		if rel, ok := within(input, root); ok {
+			return rel, nil
+		}
+	}
+
+	return "", fmt.Errorf("can't place %s under --out-dir: it's outside of the working directory", input)
+}
+
+// Get the path relative to dir, if the path is inside of it
+func within(path string, dir string) (string, bool) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+
+	rel, err := filepath.Rel(absDir, absPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+
+	return rel, true
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A pattern of a .gitignore file
+type ignoreRule struct {
+	re *regexp.Regexp
+	// the pattern started with "!", a match re-includes the path
+	negate bool
+	// the pattern ended with "/", it only matches directories
+	dirOnly bool
+}
+
+// The .gitignore files found in a directory tree, by the slash separated path of the
+// directory they are in relative to the root of the tree, "." for the root
+type gitignores map[string][]ignoreRule
+
+// Read the .gitignore file of the directory of the tree, if it has one
+func (g gitignores) read(root string, rel string) error {
+	data, err := os.ReadFile(filepath.Join(root, rel, ".gitignore"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	g[filepath.ToSlash(rel)] = parseGitignore(string(data))
+	return nil
+}
+
+// Check whether the path relative to the root of the tree is ignored, by the last pattern
+// matching it from the .gitignore files of the directories above it, the deepest last
+func (g gitignores) ignored(rel string, isDir bool) bool {
+	rel = filepath.ToSlash(rel)
+
+	ignored := false
+	for dir := range ancestors(rel) {
+		sub := rel
+		if dir != "." {
+			sub = strings.TrimPrefix(rel, dir+"/")
+		}
+
+		for _, rule := range g[dir] {
+			if (!rule.dirOnly || isDir) && rule.re.MatchString(sub) {
+				ignored = !rule.negate
+			}
+		}
+	}
+
+	return ignored
+}
+
+// Iterate over the directories containing the slash separated path, from the root "."
+// down to its parent
+func ancestors(rel string) func(yield func(string) bool) {
+	return func(yield func(string) bool) {
+		if !yield(".") {
+			return
+		}
+		for i, c := range rel {
+			if c == '/' && !yield(rel[:i]) {
+				return
+			}
+		}
+	}
+}
+
+// Parse the patterns of a .gitignore file, skipping blank lines and comments
+func parseGitignore(data string) []ignoreRule {
+	var rules []ignoreRule
+	for line := range strings.Lines(data) {
+		line = strings.TrimRight(line, "\r\n")
+		// trailing spaces are ignored unless escaped
+		if trimmed := strings.TrimRight(line, " "); !strings.HasSuffix(trimmed, "\\") {
+			line = trimmed
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate, line = true, line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly, line = true, strings.TrimSuffix(line, "/")
+		}
+
+		re, err := ignorePattern(line)
+		if err != nil {
+			// git skips patterns it can't parse
+			continue
+		}
+		rule.re = re
+
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+// Compile a .gitignore pattern into a regexp matching slash separated relative paths. A
+// pattern with a slash other than a trailing one is anchored to the directory of the
+// file, otherwise it matches a name at any depth, and "**" matches any number of directories
+func ignorePattern(pattern string) (*regexp.Regexp, error) {
+	if !strings.Contains(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case pattern[i:] == "/**":
+			expr.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				expr.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+
+	return regexp.Compile(expr.String())
+}
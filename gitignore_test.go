@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestIgnorePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"*.gen.libsonnet", "a.gen.libsonnet", true},
+		{"*.gen.libsonnet", "lib/a.gen.libsonnet", true},
+		{"*.gen.libsonnet", "a.libsonnet", false},
+		{"/local.libsonnet", "local.libsonnet", true},
+		{"/local.libsonnet", "sub/local.libsonnet", false},
+		{"lib/*.libsonnet", "lib/a.libsonnet", true},
+		{"lib/*.libsonnet", "lib/sub/a.libsonnet", false},
+		{"lib/**/a.libsonnet", "lib/a.libsonnet", true},
+		{"lib/**/a.libsonnet", "lib/x/y/a.libsonnet", true},
+		{"lib/**", "lib/x/a.libsonnet", true},
+		{"lib/**", "lib", false},
+		{"a?.libsonnet", "ab.libsonnet", true},
+		{"a?.libsonnet", "a/.libsonnet", false},
+		{"[ab].libsonnet", "b.libsonnet", true},
+		{"[!ab].libsonnet", "b.libsonnet", false},
+		{`\#a.libsonnet`, "#a.libsonnet", true},
+		{"a.libsonnet", "a_libsonnet", false},
+	}
+
+	for _, tt := range tests {
+		re, err := ignorePattern(tt.pattern)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.pattern, err)
+		}
+		if got := re.MatchString(tt.path); got != tt.want {
+			t.Errorf("pattern %q matches %q: %t, want %t", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestIgnored(t *testing.T) {
+	g := gitignores{
+		".":   parseGitignore("# generated\nbuild/\n*.gen.libsonnet\n!keep.gen.libsonnet\n\n"),
+		"lib": parseGitignore("/local.libsonnet\n"),
+	}
+
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"a.libsonnet", false, false},
+		{"b.gen.libsonnet", false, true},
+		{"lib/b.gen.libsonnet", false, true},
+		{"keep.gen.libsonnet", false, false},
+		{"build", true, true},
+		{"build", false, false},
+		{"lib/local.libsonnet", false, true},
+		{"lib/sub/local.libsonnet", false, false},
+		{"local.libsonnet", false, false},
+	}
+
+	for _, tt := range tests {
+		if got := g.ignored(filepath.FromSlash(tt.path), tt.isDir); got != tt.want {
+			t.Errorf("%s ignored (dir %t): %t, want %t", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestDirInputsGitignore(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		".gitignore":              "build/\n*.gen.libsonnet\n!keep.gen.libsonnet\n",
+		"a.libsonnet":             "{}\n",
+		"b.gen.libsonnet":         "{}\n",
+		"keep.gen.libsonnet":      "{}\n",
+		"build/out.libsonnet":     "{}\n",
+		"build/deep/x.jsonnet":    "{}\n",
+		"lib/.gitignore":          "/local.libsonnet\n",
+		"lib/local.libsonnet":     "{}\n",
+		"lib/util.libsonnet":      "{}\n",
+		"lib/sub/local.libsonnet": "{}\n",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		gitignore bool
+		want      []string
+	}{
+		{true, []string{"a.libsonnet", "keep.gen.libsonnet", "lib/sub/local.libsonnet", "lib/util.libsonnet"}},
+		{false, []string{"a.libsonnet", "b.gen.libsonnet", "build/deep/x.jsonnet", "build/out.libsonnet", "keep.gen.libsonnet",
+			"lib/local.libsonnet", "lib/sub/local.libsonnet", "lib/util.libsonnet"}},
+	}
+
+	for _, tt := range tests {
+		inputs, _, err := dirInputs(dir, nil, nil, tt.gitignore)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var want []string
+		for _, name := range tt.want {
+			want = append(want, filepath.Join(dir, filepath.FromSlash(name)))
+		}
+		if !slices.Equal(inputs, want) {
+			t.Errorf("gitignore %t: inputs %v, want %v", tt.gitignore, inputs, want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Expand the inputs that are glob patterns the shell didn't expand, e.g. 'lib/**/*.libsonnet',
+// into the files matching them sorted by path, keeping the other inputs where they are. The
+// matches already given by an earlier input are left out, and a pattern matching nothing is an
+// error. Also returns the directories walked for the patterns
+func expandGlobs(inputs []string) ([]string, []string, error) {
+	var expanded, dirs []string
+	for _, input := range inputs {
+		if !isGlob(input) {
+			expanded = append(expanded, input)
+			continue
+		}
+
+		matches, walked, err := globFiles(input)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid input pattern %q: %w", input, err)
+		}
+		if len(matches) == 0 {
+			return nil, nil, fmt.Errorf("no files match %s", input)
+		}
+		dirs = append(dirs, walked...)
+
+		for _, match := range matches {
+			if !slices.Contains(expanded, match) {
+				expanded = append(expanded, match)
+			}
+		}
+	}
+
+	return expanded, dirs, nil
+}
+
+// Check whether the input is a glob pattern rather than a file, a file that exists with
+// that name is taken as is
+func isGlob(input string) bool {
+	if !strings.ContainsAny(input, "*?[") {
+		return false
+	}
+
+	_, err := os.Stat(input)
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+// Find the files matching the pattern, walking the directory before its first segment with
+// a wildcard, and the directories walked. Each segment is matched like filepath.Match, and a
+// "**" segment matches any number of directories
+func globFiles(pattern string) ([]string, []string, error) {
+	segments := strings.Split(filepath.ToSlash(pattern), "/")
+
+	fixed := 0
+	for fixed < len(segments)-1 && !strings.ContainsAny(segments[fixed], "*?[") {
+		fixed++
+	}
+
+	root := strings.Join(segments[:fixed], "/")
+	switch {
+	case fixed == 0:
+		root = "."
+	case root == "":
+		root = "/"
+	}
+
+	var files, dirs []string
+	err := filepath.WalkDir(root, func(file string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && file == root {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			dirs = append(dirs, file)
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+
+		ok, err := matchSegments(segments[fixed:], strings.Split(filepath.ToSlash(rel), "/"))
+		if ok {
+			files = append(files, file)
+		}
+
+		return err
+	})
+
+	slices.Sort(files)
+
+	return files, dirs, err
+}
+
+// Check whether the segments of a slash separated path match those of a pattern
+func matchSegments(pattern []string, segments []string) (bool, error) {
+	if len(pattern) == 0 {
+		return len(segments) == 0, nil
+	}
+
+	if pattern[0] == "**" {
+		for i := range len(segments) + 1 {
+			if ok, err := matchSegments(pattern[1:], segments[i:]); ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+	}
+
+	if len(segments) == 0 {
+		return false, nil
+	}
+
+	ok, err := path.Match(pattern[0], segments[0])
+	if !ok || err != nil {
+		return false, err
+	}
+
+	return matchSegments(pattern[1:], segments[1:])
+}
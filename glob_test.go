@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMatchSegments(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"*.libsonnet", "a.libsonnet", true},
+		{"*.libsonnet", "lib/a.libsonnet", false},
+		{"lib/*.libsonnet", "lib/a.libsonnet", true},
+		{"**/*.libsonnet", "a.libsonnet", true},
+		{"**/*.libsonnet", "lib/sub/a.libsonnet", true},
+		{"lib/**/*.libsonnet", "lib/a.libsonnet", true},
+		{"lib/**/*.libsonnet", "lib/x/y/a.libsonnet", true},
+		{"lib/**/*.libsonnet", "other/a.libsonnet", false},
+		{"lib/**", "lib/x/a.libsonnet", true},
+		{"**/test/*.jsonnet", "a/test/b/c.jsonnet", false},
+		{"**/**/a.jsonnet", "a.jsonnet", true},
+		{"a?.jsonnet", "ab.jsonnet", true},
+		{"[ab].jsonnet", "c.jsonnet", false},
+	}
+
+	for _, tt := range tests {
+		got, err := matchSegments(strings.Split(tt.pattern, "/"), strings.Split(tt.path, "/"))
+		if err != nil {
+			t.Fatalf("%q: %v", tt.pattern, err)
+		}
+		if got != tt.want {
+			t.Errorf("pattern %q matches %q: %t, want %t", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+
+	if _, err := matchSegments([]string{"[a"}, []string{"a"}); err == nil {
+		t.Error("malformed pattern [a: no error")
+	}
+}
+
+func TestExpandGlobs(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.libsonnet", "lib/b.libsonnet", "lib/sub/c.libsonnet", "lib/d.jsonnet"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("{}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := func(name string) string { return filepath.Join(dir, filepath.FromSlash(name)) }
+
+	// the files of a pattern are sorted, and those already given by an earlier input left out
+	got, _, err := expandGlobs([]string{path("lib/sub/c.libsonnet"), path("**/*.libsonnet"), "-"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{path("lib/sub/c.libsonnet"), path("a.libsonnet"), path("lib/b.libsonnet"), "-"}
+	if !slices.Equal(got, want) {
+		t.Errorf("inputs %v, want %v", got, want)
+	}
+
+	if _, _, err := expandGlobs([]string{path("lib/*.txt")}); err == nil || !strings.Contains(err.Error(), "no files match") {
+		t.Errorf("pattern matching nothing: error %v, want no files match", err)
+	}
+}
@@ -2,10 +2,13 @@ module github.com/nr8-io/jsonnet-bundler
 
 go 1.25.4
 
-require github.com/google/go-jsonnet v0.21.0
+require (
+	github.com/fsnotify/fsnotify v1.10.1
+	github.com/google/go-jsonnet v0.21.0
+	sigs.k8s.io/yaml v1.4.0
+)
 
 require (
 	golang.org/x/crypto v0.36.0 // indirect
 	golang.org/x/sys v0.31.0 // indirect
-	sigs.k8s.io/yaml v1.4.0 // indirect
 )
@@ -1,232 +1,679 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"hash/fnv"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
-	"sort"
-	"time"
+	"runtime/debug"
+	"slices"
+	"strings"
 
-	"github.com/google/go-jsonnet"
-	"github.com/google/go-jsonnet/ast"
+	"github.com/nr8-io/jsonnet-bundler/pkg/bundler"
 	"github.com/nr8-io/jsonnet-bundler/pkg/parser"
 )
 
-// Generate a hash-based prefix from the filename
-func hash(filename string) string {
-	h := fnv.New32a() // FNV-1a 32-bit
-	h.Write([]byte(filename))
-	// add underscore to ensure valid identifier
-	return fmt.Sprintf("_%08x", h.Sum32())
-}
+func writeOutput(output string, newSource []byte) error {
+	if output == "-" {
+		_, err := os.Stdout.Write(newSource)
+		return err
+	}
 
-// Build a line offset index for efficient lookups
-func buildLineOffsets(source []byte) []int {
-	offsets := []int{0}
-	for i, b := range source {
-		if b == '\n' {
-			offsets = append(offsets, i+1)
+	// make sure the directory of the output file exists, nothing to create for a
+	// file in the current directory
+	if dir := filepath.Dir(output); dir != "." {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return err
 		}
 	}
-	return offsets
+
+	// Write the modified source to output file
+	return os.WriteFile(output, newSource, 0644)
 }
 
-// Convert line and column to byte offset
-func lineColToOffset(lineOffsets []int, line, col int) int {
-	if line < 0 || line >= len(lineOffsets) {
-		return 0
+// Get the output file used when -o isn't given, named after the input in the current
+// directory and keeping its extension if any, e.g. `lib/main.libsonnet` is bundled into
+// `main.bundle.libsonnet`, `main.jsonnet` into `main.bundle.jsonnet` and `main` into `main.bundle`
+func defaultOutput(input string) string {
+	base := filepath.Base(input)
+	ext := filepath.Ext(base)
+
+	return strings.TrimSuffix(base, ext) + ".bundle" + ext
+}
+
+// Check whether the paths refer to the same existing file
+func sameFile(a string, b string) bool {
+	if a == "-" || b == "-" {
+		return false
+	}
+
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(aInfo, bInfo)
+}
+
+// Parse flags while allowing them to be interspersed with positional arguments,
+// e.g. `jsonnet-bundler a.libsonnet b.libsonnet -o bundle.libsonnet`
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
 	}
-	return lineOffsets[line] + col
 }
 
-// Replacement represents a text replacement in the source code
-type Replacement struct {
-	beginOffset int
-	endOffset   int
-	newValue    string
+// Flag value collecting every occurrence of a repeatable flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
 }
 
-type Context struct {
-	// prefix to be added to local binds and their usages
-	prefix string
-	// replacements to to be applied in the source
-	replacements []Replacement
-	// the original source code
-	source []byte
-	// line offsets for the source code
-	lineOffsets []int
-	// set of local binds collected to be replaced
-	localBinds map[string]struct{}
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
 }
 
-func collectLocalBindReplacement(ctx *Context, node ast.LocalBind, oldName string, newName string) (*Replacement, error) {
-	if loc := node.LocRange; loc.IsSet() {
-		beginLine, beginCol := loc.Begin.Line-1, loc.Begin.Column-1
-		endLine, _ := loc.End.Line-1, loc.End.Column-1
+// Flag value collecting the comma separated items of a repeatable flag
+type commaList []string
 
-		// Calculate end column based on oldName length, since LocRange's End may not point exactly after the variable name
-		endCol := loc.Begin.Column + len(oldName) - 1
+func (l *commaList) String() string {
+	return strings.Join(*l, ",")
+}
 
-		beginOffset := lineColToOffset(ctx.lineOffsets, beginLine, beginCol)
-		endOffset := lineColToOffset(ctx.lineOffsets, endLine, endCol)
+func (l *commaList) Set(value string) error {
+	for item := range strings.SplitSeq(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
 
-		span := string(ctx.source[beginOffset:endOffset])
+// Flag value collecting `key=value` pairs of a repeatable flag, a bare `key` takes
+// its value from the environment variable of the same name like the jsonnet command
+type keyValues map[string]string
 
-		// Verify that the extracted span matches the oldName
-		if span == oldName {
-			return &Replacement{beginOffset, endOffset, newName}, nil
+func (kv *keyValues) String() string {
+	var pairs []string
+	for key, value := range *kv {
+		pairs = append(pairs, key+"="+value)
+	}
+	slices.Sort(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+func (kv *keyValues) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok {
+		val, ok = os.LookupEnv(key)
+		if !ok {
+			return fmt.Errorf("environment variable %s was undefined", key)
 		}
 	}
+	if key == "" {
+		return fmt.Errorf("missing name in %q", value)
+	}
 
-	return nil, fmt.Errorf("no match at loc")
+	if *kv == nil {
+		*kv = make(keyValues)
+	}
+	(*kv)[key] = val
+
+	return nil
 }
 
-func collectVarReplacement(ctx *Context, node ast.Node, oldName string, newName string) (*Replacement, error) {
-	if loc := node.Loc(); loc.IsSet() {
-		beginLine, beginCol := loc.Begin.Line-1, loc.Begin.Column-1
-		endLine, endCol := loc.End.Line-1, loc.End.Column-1
+// Name the source given with --exec is bundled under, it derives the prefix and resolves
+// imports relative to the working directory
+const execName = "<exec>"
+
+var (
+	input    string
+	output   string
+	noHeader bool
+	// rebuild whenever a file the bundle depends on changes, see watch
+	watchMode bool
+	cacheDir  string
+	// bundle the matching files of a directory tree, see dirInputs
+	dir      string
+	includes stringList
+	excludes stringList
+	// bundle the files ignored by git as well
+	noGitignore bool
+	// bundle each input on its own into this directory, see buildOutDir
+	outDir    string
+	sourceMap bool
+	stats     bool
+	manifest  string
+	// only list the local binds of each input, see listLocals
+	listLocals bool
+	// print the replacements as JSON instead of writing the bundle
+	editsMode bool
+	// source bundled instead of input files, under execName
+	execCode string
+	// compare the bundle to the output instead of writing it, see checkOutput
+	checkMode bool
+	jpaths    stringList
+	roots     stringList
+	tlaStr    keyValues
+	tlaCode   keyValues
+	extStr    keyValues
+	extCode   keyValues
+
+	// only log errors, see errorLog
+	quiet bool
+	// file of default flag values, see readConfig
+	configFile string
+
+	// options the flags below are parsed into
+	opts bundler.Options
+
+	// logger of the errors, which --quiet doesn't silence unlike the default logger
+	errorLog = log.New(os.Stderr, "", log.LstdFlags)
+
+	// flags of the bundle command
+	bundleFlags = flag.NewFlagSet("bundle", flag.ExitOnError)
+
+	// version of the build, set with -ldflags "-X main.version=..."
+	version = ""
+)
 
-		beginOffset := lineColToOffset(ctx.lineOffsets, beginLine, beginCol)
-		endOffset := lineColToOffset(ctx.lineOffsets, endLine, endCol)
+// Commands selected by the first argument, see main
+var commands = map[string]func(args []string) error{
+	"bundle":  runBundle,
+	"version": runVersion,
+}
 
-		span := string(ctx.source[beginOffset:endOffset])
-		if span == oldName {
-			return &Replacement{beginOffset, endOffset, newName}, nil
-		}
+func init() {
+	bundleFlags.StringVar(&configFile, "config", "", "file setting flags not given on the command line (default .jsonnet-bundler.yaml or .jsonnet-bundler.json if present)")
+	bundleFlags.StringVar(&input, "i", "", "path to the input Jsonnet file, or - to read from stdin")
+	bundleFlags.StringVar(&input, "input", "", "path to the input Jsonnet file, or - to read from stdin")
+	bundleFlags.StringVar(&output, "o", "", "path to the output file, or - to write to stdout (default \"<input file name>.bundle<ext>\" in the current directory, or stdout when reading from stdin)")
+	bundleFlags.StringVar(&output, "output", "", "path to the output file, or - to write to stdout (default \"<input file name>.bundle<ext>\" in the current directory, or stdout when reading from stdin)")
+	bundleFlags.Usage = func() {
+		usageLine(bundleFlags.Output())
+		bundleFlags.PrintDefaults()
 	}
+	bundleFlags.StringVar(&execCode, "exec", "", "bundle this Jsonnet `code` instead of input files, writing to stdout unless -o is given")
+	bundleFlags.StringVar(&dir, "dir", "", "bundle every matching file of this directory tree, sorted by path")
+	bundleFlags.Var(&includes, "include", "glob `pattern` of the files bundled with --dir, matched against the base name or the path relative to the directory if it contains a /, may be repeated (default *.libsonnet and *.jsonnet)")
+	bundleFlags.StringVar(&outDir, "out-dir", "", "bundle each input on its own into this directory, at its path relative to --dir or the working directory")
+	bundleFlags.BoolVar(&noGitignore, "no-gitignore", false, "also bundle the files of --dir that the .gitignore files of the tree ignore")
+	bundleFlags.Var(&excludes, "exclude", "glob `pattern` of the files and directories skipped with --dir, matched like --include, may be repeated")
+	bundleFlags.BoolVar(&opts.Verbose, "v", false, "log how each local bind and variable is matched")
+	bundleFlags.BoolVar(&opts.Verbose, "verbose", false, "log how each local bind and variable is matched")
+	bundleFlags.BoolVar(&quiet, "q", false, "only log errors, no warnings, stats or watch status")
+	bundleFlags.BoolVar(&quiet, "quiet", false, "only log errors, no warnings, stats or watch status")
+	bundleFlags.Var(&jpaths, "J", "additional library search directory, may be repeated, the first match wins")
+	bundleFlags.Var(&jpaths, "jpath", "additional library search directory, may be repeated, the first match wins")
+	bundleFlags.StringVar(&opts.Vendor, "vendor", "", "vendor directory of a jsonnet-bundler (jb) project, searched after the library directories")
+	bundleFlags.Var(&roots, "import-root", "directory every import must resolve into, may be repeated, imports are unrestricted when not given")
+	bundleFlags.BoolVar(&opts.InlineImports, "inline-imports", false, "recursively replace imports with the bundled source of the imported files")
+	bundleFlags.BoolVar(&opts.NormalizeNewline, "normalize-newline", false, "end the output with exactly one newline, otherwise it ends like the last input file")
+	bundleFlags.IntVar(&opts.Indent, "indent", 0, "indent the source of each inlined file by `n` spaces, keeping the original indentation when 0")
+	bundleFlags.IntVar(&opts.MaxDepth, "max-depth", bundler.DefaultMaxDepth, "fail when imports are inlined deeper than `n` levels")
+	bundleFlags.BoolVar(&opts.Format, "fmt", false, "format the bundled output like jsonnet fmt")
+	bundleFlags.BoolVar(&opts.Verify, "verify", false, "check that the bundled output parses as valid Jsonnet before writing it")
+	bundleFlags.BoolVar(&opts.CheckEval, "check-eval", false, "evaluate each bundled file and its original and fail unless both evaluate to the same JSON")
+	bundleFlags.BoolVar(&opts.Strict, "strict", false, "fail when a local bind or variable could not be renamed instead of logging a warning")
+	bundleFlags.BoolVar(&opts.StrictBinds, "strict-binds", false, "fail when a local bind could not be renamed, listing the binds skipped, still only warning about variables")
+	bundleFlags.Var(&tlaStr, "tla-str", "top-level argument `key=value` passed as a string when evaluating for --check-eval, may be repeated")
+	bundleFlags.Var(&tlaCode, "tla-code", "top-level argument `key=expr` passed as Jsonnet code when evaluating for --check-eval, may be repeated")
+	bundleFlags.Var(&extStr, "ext-str", "external variable `key=value` passed as a string, may be repeated")
+	bundleFlags.Var(&extCode, "ext-code", "external variable `key=expr` passed as Jsonnet code, may be repeated")
+	bundleFlags.BoolVar(&watchMode, "watch", false, "rebuild whenever the input files or the files they import change")
+	bundleFlags.StringVar(&cacheDir, "cache-dir", "", "directory caching the parsed results of unchanged files across runs")
+	bundleFlags.BoolVar(&sourceMap, "source-map", false, "write a map relating positions in the output back to the original files to <output>.map")
+	bundleFlags.StringVar(&manifest, "manifest", "", "write the list of files bundled with their prefixes and content hashes to this JSON file")
+	bundleFlags.BoolVar(&stats, "stats", false, "print how many files were bundled and locals renamed to stderr, also printed with -v")
+	bundleFlags.BoolVar(&listLocals, "list-locals", false, "print the local binds of each input that would be prefixed, with their location, instead of bundling")
+	bundleFlags.BoolVar(&checkMode, "check", false, "don't write the output, fail with a diff if it isn't what bundling the inputs gives, ignoring the time in the header")
+	bundleFlags.BoolVar(&editsMode, "edits", false, "print every replacement bundling makes as JSON to stdout instead of writing any output, for editor tooling")
+	bundleFlags.BoolVar(&opts.DryRun, "dry-run", false, "print the replacements that would be made to stderr without writing any output")
+	bundleFlags.BoolVar(&noHeader, "no-header", false, "do not prepend the auto-generated header comment")
+	bundleFlags.StringVar(&opts.HeaderRoot, "header-root", "", "directory the file names in the header and section comments are relative to (default the working directory)")
+	bundleFlags.StringVar(&opts.HeaderTemplate, "header-template", "", "Go text/template for the header comment, receiving .Source, .Time and .Prefix, also written to stdout (default \""+bundler.DefaultHeaderTemplate+"\")")
+	bundleFlags.IntVar(&opts.PreserveLeading, "preserve-leading", 0, "keep the first `n` comment lines of the input above the header, after a leading #! line which is always kept first")
+	bundleFlags.StringVar((*string)(&opts.PrefixStyle), "prefix-style", string(bundler.PrefixStyleHash), "how prefixes are derived from file names, hash for a hash of the path or path for the path itself, e.g. lib_util for lib/util.libsonnet")
+	bundleFlags.StringVar(&opts.Hash, "hash", "fnv", "hash algorithm used to derive prefixes from file names, one of "+strings.Join(bundler.HasherNames(), ", "))
+	bundleFlags.StringVar(&opts.HashRoot, "hash-root", "", "derive prefixes from file paths relative to this directory")
+	bundleFlags.Var((*commaList)(&opts.ExcludeNames), "exclude-names", "comma separated `names` of local binds that are never prefixed, may be repeated")
+	bundleFlags.BoolVar(&opts.StripLeadingComments, "strip-leading-comments", false, "remove the comments before the code of each file, keeping a leading #! line")
+	bundleFlags.BoolVar(&opts.WarnUnused, "warn-unused", false, "log a warning for each prefixed local that no variable refers to")
+	bundleFlags.BoolVar(&opts.KeepAliases, "keep-aliases", false, "bind the original name of each prefixed local to its prefixed name, keeping the bundled source readable")
+	bundleFlags.BoolVar(&opts.OnlyExported, "only-exported", false, "only prefix the locals at the root of each file, leaving nested locals alone")
+	bundleFlags.StringVar((*string)(&opts.Strategy), "strategy", string(bundler.StrategyRename), "how files are kept apart, rename to prefix every local, wrap to only bind each inlined file to a local or object to prefix every local and make each file a field of an object")
+	bundleFlags.StringVar(&opts.Prefix, "prefix", "", "namespace used to prefix local binds instead of a hash of the file name")
+	bundleFlags.StringVar(&opts.PrefixSeparator, "prefix-separator", "_", "text between the prefix and the name of each local bind, e.g. __ to set prefixed names apart")
+}
 
-	return nil, fmt.Errorf("no match at loc")
+// Error in the arguments of a command, reported along with the usage
+type usageError struct {
+	err error
 }
 
-func collectLocalBindReplacements(ctx *Context, node ast.Node) {
-	fmt.Printf("TYPE: %T (begin: %v, end: %v)\n", node, node.Loc().Begin, node.Loc().End)
-	switch n := node.(type) {
-	case *ast.Local:
-		for _, b := range n.Binds {
-			rep, err := collectLocalBindReplacement(ctx, b, string(b.Variable), ctx.prefix+"_"+string(b.Variable))
+func (e usageError) Error() string {
+	return e.err.Error()
+}
 
-			if err == nil {
-				ctx.replacements = append(ctx.replacements, *rep)
-				ctx.localBinds[string(b.Variable)] = struct{}{}
-			}
-		}
+func (e usageError) Unwrap() error {
+	return e.err
+}
 
-		// parser gives back [node.Body, ...n.Binds]
-		children := parser.Children(node)
+func usagef(format string, v ...any) error {
+	return usageError{fmt.Errorf(format, v...)}
+}
 
-		// look for supported import nodes among the children
-		for _, child := range children[1:] {
-			switch child.(type) {
-			case *ast.Import:
-				fmt.Println("Import node found")
-			case *ast.ImportStr:
-				fmt.Println("ImportStr node found")
-			case *ast.ImportBin:
-				fmt.Println("ImportBin node found")
-			default:
-				// handle other child nodes recursively
-				collectLocalBindReplacements(ctx, child)
-			}
-		}
+// Print the short usage of the commands
+func usageLine(w io.Writer) {
+	name := filepath.Base(os.Args[0])
+	fmt.Fprintf(w, "Usage: %s [bundle] [flags] [-i] <input> [<input>...]\n       %s version\n", name, name)
+}
 
-		// Continue to the body of the local expression
-		collectLocalBindReplacements(ctx, n.Body)
+// Exit codes of the command, besides 0 on success
+const (
+	// bundling or writing the output failed
+	exitFailure = 1
+	// the arguments are invalid, like flag parse errors
+	exitUsage = 2
+)
+
+func main() {
+	err := run(os.Args[1:])
+
+	var usage usageError
+	switch {
+	case err == nil:
+	case errors.As(err, &usage):
+		fmt.Fprintln(os.Stderr, err)
+		usageLine(os.Stderr)
+		fmt.Fprintf(os.Stderr, "Run '%s -h' for the list of flags\n", filepath.Base(os.Args[0]))
+		os.Exit(exitUsage)
 	default:
-		for _, child := range parser.Children(node) {
-			collectLocalBindReplacements(ctx, child)
-		}
+		errorLog.Print(err)
+		os.Exit(exitFailure)
 	}
 }
 
-func collectVarReplacements(ctx *Context, node ast.Node) {
-	switch n := node.(type) {
-	case *ast.Var:
-		if _, ok := ctx.localBinds[string(n.Id)]; ok {
-			rep, err := collectVarReplacement(ctx, n, string(n.Id), ctx.prefix+"_"+string(n.Id))
-			if err == nil {
-				ctx.replacements = append(ctx.replacements, *rep)
-			}
+// Run the command selected by the first argument
+func run(args []string) error {
+	// without a command the arguments are bundled, like before commands were added
+	name := "bundle"
+	if len(args) > 0 {
+		if _, ok := commands[args[0]]; ok {
+			name, args = args[0], args[1:]
 		}
 	}
 
-	for _, child := range parser.Children(node) {
-		collectVarReplacements(ctx, child)
-	}
+	return commands[name](args)
 }
 
-func applyReplacements(ctx *Context) []byte {
-	reps := ctx.replacements
-
-	// Sort replacements by beginOffset descending to handle overlapping replacements correctly
-	sort.Slice(reps, func(i, j int) bool {
-		return reps[i].beginOffset > reps[j].beginOffset
-	})
+// Print the version of the build, the module version when installed with go install
+func runVersion(args []string) error {
+	if len(args) > 0 {
+		return usagef("unexpected arguments: %s", strings.Join(args, " "))
+	}
 
-	// Loop through replacements and apply them to the source
-	out := ctx.source
-	for _, rep := range reps {
-		out = append(out[:rep.beginOffset], append([]byte(rep.newValue), out[rep.endOffset:]...)...)
+	v := version
+	if info, ok := debug.ReadBuildInfo(); ok && v == "" {
+		v = info.Main.Version
+	}
+	if v == "" {
+		v = "(devel)"
 	}
 
-	return out
+	fmt.Println(v)
+
+	return nil
 }
 
-func process(inputDir string, sourceFile string) error {
-	sourceDir := filepath.Dir(sourceFile)
+// Bundle the input files given in args
+func runBundle(args []string) error {
+	// flag.ExitOnError makes parse errors exit on their own
+	inputs, _ := parseArgs(bundleFlags, args)
 
-	code, err := os.ReadFile(inputDir + "/" + sourceFile)
+	configInputs, err := readConfig(bundleFlags, configFile)
 	if err != nil {
 		return err
 	}
-
-	// Initialize context for processing
-	ctx := &Context{
-		// prefix as hash of the current file name
-		prefix:      hash(sourceFile),
-		source:      code,
-		lineOffsets: buildLineOffsets(code),
-		localBinds:  make(map[string]struct{}),
+	if len(inputs) == 0 && input == "" {
+		inputs = configInputs
 	}
 
-	// Create Jsonnet VM and parse the input file as AST for accurate location info
-	vm := jsonnet.MakeVM()
+	// the input may be given with -i/--input, as positional arguments, or both
+	if input != "" {
+		inputs = append([]string{input}, inputs...)
+	}
 
-	node, _, err := vm.ImportAST("", inputDir+"/"+sourceFile)
+	given := inputs
+	inputs, _, err = resolveInputs(given)
 	if err != nil {
 		return err
 	}
 
-	// First pass to collect and replace local binds
-	collectLocalBindReplacements(ctx, node)
-	// Second pass to collect and replace variable usages
-	collectVarReplacements(ctx, node)
+	if quiet && opts.Verbose {
+		return usagef("invalid flags: --quiet and --verbose can't be combined")
+	}
+	if quiet {
+		log.SetOutput(io.Discard)
+	}
 
-	// Apply all collected replacements to the source code
-	newSource := applyReplacements(ctx)
+	if opts.Prefix != "" && !parser.IsValidIdentifier(opts.Prefix) {
+		return usagef("invalid prefix %q: must be a valid Jsonnet identifier", opts.Prefix)
+	}
 
-	// add comment to the top of the file indicating it is auto-generated
-	newSource = append([]byte("// Auto-generated by jsonnet-bundler at "+time.Now().Format(time.RFC3339)+" for "+sourceFile+"\n"), newSource...)
+	if !bundler.ValidPrefixSeparator(opts.PrefixSeparator) {
+		return usagef("invalid prefix separator %q: must only contain letters, digits and underscores", opts.PrefixSeparator)
+	}
 
-	// make sure output directory exists
-	err = os.MkdirAll("output/"+sourceDir, os.ModePerm)
-	if err != nil {
-		return err
+	if !slices.Contains([]bundler.PrefixStyle{bundler.PrefixStyleHash, bundler.PrefixStylePath}, opts.PrefixStyle) {
+		return usagef("invalid prefix style %q: must be %s or %s", opts.PrefixStyle, bundler.PrefixStyleHash, bundler.PrefixStylePath)
 	}
 
-	// Write the modified source to output file
-	err = os.WriteFile("output/"+sourceFile, newSource, 0644)
+	if !slices.Contains(bundler.HasherNames(), opts.Hash) {
+		return usagef("invalid hash %q: must be one of %s", opts.Hash, strings.Join(bundler.HasherNames(), ", "))
+	}
+
+	for _, name := range opts.ExcludeNames {
+		if !parser.IsValidIdentifier(name) {
+			return usagef("invalid excluded name %q: must be a valid Jsonnet identifier", name)
+		}
+	}
+
+	if !slices.Contains([]bundler.Strategy{bundler.StrategyRename, bundler.StrategyWrap, bundler.StrategyObject}, opts.Strategy) {
+		return usagef("invalid strategy %q: must be %s, %s or %s", opts.Strategy, bundler.StrategyRename, bundler.StrategyWrap, bundler.StrategyObject)
+	}
+
+	if opts.MaxDepth < 1 {
+		return usagef("invalid max depth %d: must be positive", opts.MaxDepth)
+	}
+
+	if execCode != "" {
+		// end the code like a file so the bundle ends with a newline
+		if !strings.HasSuffix(execCode, "\n") {
+			execCode += "\n"
+		}
+
+		switch {
+		case len(inputs) > 0:
+			return usagef("invalid input: --exec can't be combined with input files")
+		case watchMode:
+			return usagef("invalid input: --watch can't watch --exec code")
+		case output == "":
+			output = "-"
+		}
+	} else if len(inputs) == 0 {
+		return usagef("missing input: pass -i/--input, --dir, --exec or one or more input files")
+	}
+
+	if listLocals {
+		return printLocals(inputs)
+	}
+
+	if outDir != "" {
+		switch {
+		case execCode != "":
+			return usagef("invalid input: --out-dir needs input files, not --exec code")
+		case slices.Contains(inputs, "-"):
+			return usagef("invalid input: --out-dir can't bundle stdin")
+		case output != "" || watchMode || manifest != "":
+			return usagef("invalid flags: --out-dir can't be combined with -o/--output, --watch or --manifest")
+		}
+	} else if output == "" {
+		switch {
+		case len(inputs) > 1 && !opts.DryRun && !editsMode:
+			return usagef("missing required flag: -o/--output is required when bundling multiple files")
+		case inputs[0] == "-":
+			output = "-"
+		default:
+			output = defaultOutput(inputs[0])
+		}
+	}
+
+	if slices.ContainsFunc(inputs, func(input string) bool { return sameFile(input, output) }) {
+		return usagef("invalid output: %s is also an input file", output)
+	}
+
+	opts.JPaths = jpaths
+	opts.ImportRoots = roots
+	opts.TLAStr = tlaStr
+	opts.TLACode = tlaCode
+	opts.ExtStr = extStr
+	opts.ExtCode = extCode
+	// skip the header when writing to stdout so the output can be piped straight into jsonnet,
+	// unless a header template asks for one
+	opts.Header = (output != "-" || opts.HeaderTemplate != "") && !noHeader
+
+	if opts.Indent < 0 {
+		return usagef("invalid indent %d: must not be negative", opts.Indent)
+	}
+
+	if editsMode && (checkMode || watchMode || outDir != "") {
+		return usagef("invalid flags: --edits can't be combined with --check, --watch or --out-dir")
+	}
+
+	if checkMode && (output == "-" || watchMode) {
+		return usagef("invalid flags: --check needs an output file and can't be combined with --watch")
+	}
+
+	if sourceMap && (output == "-" || opts.Format || opts.Indent > 0) {
+		return usagef("invalid flags: --source-map needs an output file and can't be combined with --fmt or --indent")
+	}
+
+	// watch mode always caches in memory so only the changed files are parsed again
+	if cacheDir != "" || watchMode {
+		opts.Cache = bundler.NewCache(cacheDir)
+	}
+
+	if watchMode {
+		if slices.Contains(inputs, "-") {
+			return usagef("invalid input: --watch can't read from stdin")
+		}
+
+		return watch(given, inputs, output, nil)
+	}
+
+	if outDir != "" {
+		return buildOutDir(inputs)
+	}
+
+	_, err = build(inputs, output)
+	return err
+}
+
+// Resolve the inputs as given into the files to bundle, expanding the glob patterns and adding
+// the files of the --dir tree. Also returns the directories walked for them, where a file
+// being added or removed may change the inputs
+func resolveInputs(given []string) ([]string, []string, error) {
+	inputs, dirs, err := expandGlobs(given)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+
+	if dir != "" {
+		files, tree, err := dirInputs(dir, includes, excludes, !noGitignore)
+		if err != nil {
+			return nil, nil, err
+		}
+		dirs = append(dirs, tree...)
+
+		// the copies written by a previous run into the tree aren't inputs
+		if outDir != "" {
+			files = slices.DeleteFunc(files, func(file string) bool {
+				_, ok := within(file, outDir)
+				return ok
+			})
+		}
+		if len(files) == 0 {
+			return nil, nil, fmt.Errorf("no files to bundle in %s", dir)
+		}
+
+		inputs = append(inputs, files...)
+	}
+
+	return inputs, dirs, nil
+}
+
+// Bundle each input on its own into the --out-dir tree, going on with the others when
+// one fails and reporting every failure at the end
+func buildOutDir(inputs []string) error {
+	var errs []error
+	for _, input := range inputs {
+		rel, err := outDirPath(input, dir)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		output := filepath.Join(outDir, rel)
+		if sameFile(input, output) {
+			errs = append(errs, fmt.Errorf("invalid output: %s is also an input file", output))
+			continue
+		}
+
+		if _, err := build([]string{input}, output); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Print the local binds each input declares that bundling would prefix, one per line
+func printLocals(inputs []string) error {
+	opts := opts
+	opts.JPaths = jpaths
+	opts.ExtStr = extStr
+	opts.ExtCode = extCode
+
+	if execCode != "" {
+		inputs = []string{execName}
+	}
+
+	for _, input := range inputs {
+		filename := input
+		var source []byte
+		var err error
+		switch input {
+		case execName:
+			source = []byte(execCode)
+		case "-":
+			filename = "<stdin>"
+			source, err = io.ReadAll(os.Stdin)
+		default:
+			source, err = os.ReadFile(input)
+		}
+		if err != nil {
+			return err
+		}
+
+		locals, err := bundler.Locals(source, filename, opts)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+
+		for _, l := range locals {
+			fmt.Printf("%s:%d:%d: %s -> %s\n", l.Filename, l.Line, l.Column, l.OldName, l.NewName)
+		}
 	}
 
 	return nil
 }
 
-func main() {
-	err := process("input", "konn/main.libsonnet")
+// Bundle the inputs and write the result to output, returning the files the bundle depends on
+func build(inputs []string, output string) ([]string, error) {
+	opts := opts
+	if sourceMap {
+		opts.SourceMap = &bundler.SourceMap{}
+	}
+	if stats || opts.Verbose {
+		opts.Stats = &bundler.Stats{}
+	}
+	if manifest != "" {
+		opts.Manifest = &bundler.Manifest{}
+	}
+	if editsMode {
+		opts.Edits = &bundler.Edits{}
+	}
+	if checkMode {
+		opts.HeaderTime = timePlaceholder
+	}
+
+	var newSource []byte
+	var files []string
+	var err error
+	if execCode != "" {
+		newSource, err = bundler.Bundle([]byte(execCode), execName, opts)
+	} else {
+		newSource, files, err = bundler.BundleFilesDeps(inputs, opts)
+	}
 	if err != nil {
-		log.Fatal(err)
+		return files, err
 	}
+
+	if opts.DryRun {
+		return files, nil
+	}
+
+	if checkMode {
+		return files, checkOutput(output, newSource)
+	}
+
+	if editsMode {
+		return files, writeJSON("-", opts.Edits)
+	}
+
+	if err := writeOutput(output, newSource); err != nil {
+		return files, err
+	}
+
+	if s := opts.Stats; s != nil {
+		log.Printf("stats for %s: files bundled %d, local binds renamed %d, variables renamed %d, bytes %d",
+			output, s.Files, s.LocalBinds, s.Vars, s.Bytes)
+	}
+
+	if sourceMap {
+		if err := writeJSON(output+".map", opts.SourceMap); err != nil {
+			return files, err
+		}
+	}
+
+	if manifest != "" {
+		if err := writeJSON(manifest, opts.Manifest); err != nil {
+			return files, err
+		}
+	}
+
+	return files, nil
+}
+
+// Write the value as indented JSON to the output file
+func writeJSON(output string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(output, append(data, '\n'))
 }
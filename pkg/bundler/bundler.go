@@ -0,0 +1,1593 @@
+// Package bundler namespaces the local binds of Jsonnet files with a per-file prefix
+// so that several files, and optionally the files they import, can be combined into one
+package bundler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/google/go-jsonnet"
+	"github.com/google/go-jsonnet/ast"
+	"github.com/google/go-jsonnet/formatter"
+	"github.com/nr8-io/jsonnet-bundler/pkg/parser"
+)
+
+// Build a line offset index for efficient lookups, lines are split on `\n` only so a `\r`
+// of a CRLF line ending counts as the last column of its line, the same way the
+// go-jsonnet lexer counts it, and CRLF sources need no normalizing
+func buildLineOffsets(source []byte) []int {
+	// count the lines first so the index of a large generated file is allocated once
+	offsets := make([]int, 1, bytes.Count(source, []byte{'\n'})+1)
+	for i := 0; ; {
+		n := bytes.IndexByte(source[i:], '\n')
+		if n < 0 {
+			return offsets
+		}
+		i += n + 1
+		offsets = append(offsets, i)
+	}
+}
+
+// Convert line and column to byte offset, go-jsonnet counts columns in bytes from the
+// start of the line, not runes, so multi-byte UTF-8 needs no special handling
+func lineColToOffset(lineOffsets []int, line, col int) int {
+	if line < 0 || line >= len(lineOffsets) {
+		return 0
+	}
+	return lineOffsets[line] + col
+}
+
+// Convert byte offset back to 1-based line and column, binary searching the line offsets
+// so diagnostics stay fast on large files
+func offsetToLineCol(lineOffsets []int, offset int) (int, int) {
+	line := sort.SearchInts(lineOffsets, offset+1) - 1
+	if line < 0 {
+		return 1, 1
+	}
+	return line + 1, offset - lineOffsets[line] + 1
+}
+
+// Convert line and column to byte offset in the source of the context, clamped to the
+// bounds of the source so a location on a last line without a trailing newline, or
+// running past the end, never slices out of range
+func (ctx *Context) offset(line, col int) int {
+	return min(max(lineColToOffset(ctx.LineOffsets, line, col), 0), len(ctx.Source))
+}
+
+// Convert byte offset in the source of the context to its location, for reporting
+func (ctx *Context) location(offset int) ast.Location {
+	line, col := offsetToLineCol(ctx.LineOffsets, offset)
+	return ast.Location{Line: line, Column: col}
+}
+
+// Replacement represents a text replacement in the source code
+type Replacement struct {
+	// byte offset in the source where the replaced span begins
+	BeginOffset int
+	// byte offset in the source just after the replaced span
+	EndOffset int
+	// text replacing the span
+	NewValue string
+	// name replaced for renames, the span as found in the source
+	OldName string
+	// what the replacement is for, see the Kind constants
+	Kind Kind
+}
+
+// Kind of a replacement, or of a rename in a Report
+type Kind string
+
+const (
+	// the name of a local bind or object local
+	LocalBind Kind = "localBind"
+	// a variable resolving to a local bind
+	VarUsage Kind = "varUsage"
+	// an import replaced with the local bound to the inlined file
+	Import Kind = "import"
+	// an importstr replaced with a string literal of the file content
+	ImportStr Kind = "importstr"
+	// the leading comments of a file removed with Options.StripLeadingComments
+	Comment Kind = "comment"
+	// a local binding the original names of prefixed binds, with Options.KeepAliases
+	Alias Kind = "alias"
+)
+
+// A rename applied to a bundled file, reported by BundleReport
+type Rename struct {
+	// name of the file the rename was applied to
+	Filename string
+	// the name in the original source
+	OldName string
+	// the prefixed name
+	NewName string
+	// 1-based location of the name in the original source
+	Line   int
+	Column int
+	// LocalBind or VarUsage
+	Kind Kind
+}
+
+// Get the renames among the replacements of the context, in source order
+func renames(ctx *Context) []Rename {
+	var out []Rename
+	for _, rep := range ctx.Replacements {
+		if rep.Kind != LocalBind && rep.Kind != VarUsage {
+			continue
+		}
+
+		loc := ctx.location(rep.BeginOffset)
+		out = append(out, Rename{ctx.Filename, rep.OldName, rep.NewValue, loc.Line, loc.Column, rep.Kind})
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Line < out[j].Line || out[i].Line == out[j].Line && out[i].Column < out[j].Column
+	})
+
+	return out
+}
+
+// Log a debug message when bundling with Options.Verbose, see -v/--verbose
+func (ctx *Context) debugf(format string, v ...any) {
+	if ctx.opts.Verbose {
+		log.Printf("DEBUG "+format, v...)
+	}
+}
+
+// Context holds the state of bundling a single file, custom passes may add to or
+// remove from Replacements between collection and ApplyReplacements
+type Context struct {
+	// name of the file being processed
+	Filename string
+	// prefix to be added to local binds and their usages
+	Prefix string
+	// replacements to to be applied in the source
+	Replacements []Replacement
+	// the original source code
+	Source []byte
+	// the source as read, with the byte order mark Source doesn't have, see newContext
+	raw []byte
+	// line offsets for the source code, see buildLineOffsets
+	LineOffsets []int
+	// renames that couldn't be applied because the name wasn't found at its location,
+	// each a *RenameError
+	Failures []error
+	// prefixed local binds that no variable refers to, in source order
+	Unused []Rename
+	// options of the bundle the file is part of
+	opts *Options
+	// local binds collected to be replaced, keyed by the *ast.LocalBind of the bind site
+	// or, for object locals before desugaring, the *ast.ObjectField
+	localBinds map[any]*binding
+	// stack of scopes enclosing the node being visited by the variable pass
+	scopes []scope
+	// import state shared with the contexts of all other files in the bundle
+	imports *importState
+	// stack of files being bundled, from the input file down to this one, used to detect import cycles
+	importing []string
+}
+
+// Get the location of a bind, starting at its name
+func bindLocation(node ast.LocalBind) ast.LocationRange {
+	// desugaring `local f(x) = ...` into a bind of a function drops the bind's location, but
+	// the function's location starts at the bind name so the span check still applies
+	if fn, ok := node.Body.(*ast.Function); ok && !node.LocRange.IsSet() {
+		return *fn.Loc()
+	}
+
+	return node.LocRange
+}
+
+func collectLocalBindReplacement(ctx *Context, node ast.LocalBind, oldName string, newName string) (*Replacement, error) {
+	if loc := bindLocation(node); loc.IsSet() {
+		beginLine, beginCol := loc.Begin.Line-1, loc.Begin.Column-1
+
+		// Calculate the end from oldName's length in bytes on the line it begins on, since LocRange's
+		// End points at the end of the whole bind which may span several lines
+		beginOffset := ctx.offset(beginLine, beginCol)
+		endOffset := min(beginOffset+len(oldName), len(ctx.Source))
+
+		span := string(ctx.Source[beginOffset:endOffset])
+
+		// Verify that the extracted span matches the oldName and isn't only the start of a longer
+		// identifier, so a location that is off never overwrites part of a neighbouring token or comment
+		if span == oldName && !isIdentifierByteAt(ctx.Source, endOffset) {
+			ctx.debugf("local bind %q at %v: match at %d-%d", oldName, &loc.Begin, beginOffset, endOffset)
+			return &Replacement{beginOffset, endOffset, newName, oldName, LocalBind}, nil
+		}
+
+		err := noMatch(ctx, beginOffset, endOffset, span)
+		if span == oldName {
+			err = fmt.Errorf("%w, part of a longer identifier", err)
+		}
+		ctx.debugf("local bind %q at %v: %v", oldName, &loc.Begin, err)
+
+		return nil, err
+	}
+
+	ctx.debugf("local bind %q: no location", oldName)
+	return nil, fmt.Errorf("no location")
+}
+
+// Describe the span that was found where a name was expected, with its position both as
+// line and column and as byte offsets
+func noMatch(ctx *Context, beginOffset, endOffset int, span string) error {
+	foundBegin, foundEnd := ctx.location(beginOffset), ctx.location(endOffset)
+	return fmt.Errorf("no match at %v-%v (bytes %d-%d), found %q", &foundBegin, &foundEnd, beginOffset, endOffset, span)
+}
+
+// Check whether the byte at offset in source can be part of an identifier
+func isIdentifierByteAt(source []byte, offset int) bool {
+	if offset < 0 || offset >= len(source) {
+		return false
+	}
+
+	b := source[offset]
+	return b == '_' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9'
+}
+
+func collectVarReplacement(ctx *Context, node ast.Node, oldName string, newName string) (*Replacement, error) {
+	if loc := node.Loc(); loc.IsSet() {
+		beginLine, beginCol := loc.Begin.Line-1, loc.Begin.Column-1
+		endLine, endCol := loc.End.Line-1, loc.End.Column-1
+
+		beginOffset := ctx.offset(beginLine, beginCol)
+		endOffset := ctx.offset(endLine, endCol)
+
+		span := string(ctx.Source[beginOffset:endOffset])
+		if span == oldName {
+			ctx.debugf("var %q at %v: match at %d-%d", oldName, &loc.Begin, beginOffset, endOffset)
+			return &Replacement{beginOffset, endOffset, newName, oldName, VarUsage}, nil
+		}
+
+		err := noMatch(ctx, beginOffset, endOffset, span)
+		ctx.debugf("var %q at %v: %v", oldName, &loc.Begin, err)
+
+		return nil, err
+	}
+
+	ctx.debugf("var %q: no location", oldName)
+	return nil, fmt.Errorf("no location")
+}
+
+// A local bind collected to be prefixed, variables are linked to the binding that
+// lexically resolves them so each bind site is renamed independently of others with the same name
+type binding struct {
+	// the original name of the bind
+	name string
+	// the prefixed name replacing it
+	newName string
+	// byte offset of the name in the source
+	offset int
+	// a variable resolves to the bind
+	used bool
+}
+
+// Collect the replacement prefixing a single bind of a local or object local,
+// key identifies the bind site for the variable pass
+func collectBind(ctx *Context, key any, b ast.LocalBind) {
+	// desugaring binds `$` to the outermost object, as an object local or, for an object
+	// comprehension, as a local around it, it isn't in the source
+	if b.Variable == "$" {
+		return
+	}
+
+	// an excluded bind keeps its name, variables resolving to it are left alone the same way
+	if slices.Contains(ctx.opts.ExcludeNames, string(b.Variable)) {
+		ctx.debugf("local bind %q at %v: excluded", b.Variable, &b.LocRange.Begin)
+		return
+	}
+
+	if loc := bindLocation(b); loc.IsSet() && hasKeepPragma(ctx, loc.Begin.Line-1) {
+		ctx.debugf("local bind %q at %v: kept by pragma", b.Variable, &loc.Begin)
+		return
+	}
+
+	newName := ctx.Prefix + ctx.opts.prefixSeparator() + string(b.Variable)
+	// the prefix of another file would shadow the local that file is inlined as, e.g.
+	// the bind `util` of `lib.libsonnet` and `lib/util.libsonnet` with named prefixes
+	for n := 2; ctx.imports.prefixes[newName] != ""; n++ {
+		newName = fmt.Sprintf("%s%s%s_%d", ctx.Prefix, ctx.opts.prefixSeparator(), b.Variable, n)
+	}
+
+	rep, err := collectLocalBindReplacement(ctx, b, string(b.Variable), newName)
+
+	if err != nil {
+		ctx.fail(LocalBind, string(b.Variable), bindLocation(b), err)
+		return
+	}
+
+	ctx.Replacements = append(ctx.Replacements, *rep)
+	ctx.localBinds[key] = &binding{name: string(b.Variable), newName: newName, offset: rep.BeginOffset}
+}
+
+// Comment opting the local binds on the line below it out of being prefixed
+const keepPragma = "jb:keep"
+
+// Check whether the line before the 0-based line is only a `// jb:keep` or `# jb:keep` comment
+func hasKeepPragma(ctx *Context, line int) bool {
+	if line < 1 || line >= len(ctx.LineOffsets) {
+		return false
+	}
+
+	prev := strings.TrimSpace(string(ctx.Source[ctx.LineOffsets[line-1]:ctx.LineOffsets[line]]))
+	for _, comment := range []string{"//", "#"} {
+		if text, ok := strings.CutPrefix(prev, comment); ok && strings.TrimSpace(text) == keepPragma {
+			return true
+		}
+	}
+
+	return false
+}
+
+// A rename that couldn't be applied
+type RenameError struct {
+	// LocalBind or VarUsage
+	Kind Kind
+	// the name that wasn't renamed
+	Name string
+	// where the parser located the name, the zero value when it has no location
+	Loc ast.Location
+	// why the name wasn't renamed
+	Reason string
+	// the new name would clash with a name that isn't prefixed, which fails the bundle
+	// whatever the options since the bundle wouldn't evaluate the same
+	Collision bool
+}
+
+func (e *RenameError) Error() string {
+	what := "local bind"
+	if e.Kind == VarUsage {
+		what = "var"
+	}
+
+	msg := fmt.Sprintf("%s %q not renamed: %s", what, e.Name, e.Reason)
+	if e.Collision {
+		msg = fmt.Sprintf("%s %q clashes after renaming: %s", what, e.Name, e.Reason)
+	}
+	if e.Loc.Line > 0 {
+		msg = fmt.Sprintf("%v: %s", &e.Loc, msg)
+	}
+
+	return msg
+}
+
+// Record the rename of the name found at loc that couldn't be applied
+func (ctx *Context) fail(kind Kind, name string, loc ast.LocationRange, err error) {
+	ctx.Failures = append(ctx.Failures, &RenameError{kind, name, loc.Begin, err.Error(), false})
+}
+
+// Record the rename of the name found at loc that would clash with another name
+func (ctx *Context) collide(kind Kind, name string, loc ast.LocationRange, format string, v ...any) {
+	ctx.Failures = append(ctx.Failures, &RenameError{kind, name, loc.Begin, fmt.Sprintf(format, v...), true})
+}
+
+// Report the renames of the context that couldn't be applied, as warnings or as an error
+// with Options.Strict, or with Options.StrictBinds for the local binds only. Collisions
+// are always an error
+func reportFailures(ctx *Context) error {
+	var fatal, warnings []error
+	collisions := false
+	for _, err := range ctx.Failures {
+		var rerr *RenameError
+		isRename := errors.As(err, &rerr)
+		collisions = collisions || isRename && rerr.Collision
+
+		if ctx.opts.Strict || isRename && (rerr.Collision || ctx.opts.StrictBinds && rerr.Kind == LocalBind) {
+			fatal = append(fatal, err)
+		} else {
+			warnings = append(warnings, err)
+		}
+	}
+
+	for _, err := range warnings {
+		log.Printf("warning: %s: %v", ctx.Filename, err)
+	}
+
+	if ctx.opts.WarnUnused {
+		for _, u := range ctx.Unused {
+			log.Printf("warning: %s:%d:%d: local %q is never used", u.Filename, u.Line, u.Column, u.OldName)
+		}
+	}
+
+	switch {
+	case len(fatal) == 0:
+		return nil
+	case ctx.opts.Strict || collisions:
+		return fmt.Errorf("%d renames could not be applied:\n%w", len(fatal), errors.Join(fatal...))
+	default:
+		return fmt.Errorf("%d local binds could not be renamed:\n%w", len(fatal), errors.Join(fatal...))
+	}
+}
+
+// First pass, collect the replacements prefixing the local binds and object locals under node
+func CollectLocalBindReplacements(ctx *Context, node ast.Node) {
+	switch n := node.(type) {
+	case *ast.Local:
+		for i := range n.Binds {
+			collectBind(ctx, &n.Binds[i], n.Binds[i])
+		}
+
+		// parser gives back [node.Body, ...n.Binds]
+		children := parser.Children(node)
+
+		// handle the bind bodies recursively
+		for _, child := range children[1:] {
+			CollectLocalBindReplacements(ctx, child)
+		}
+
+		// Continue to the body of the local expression
+		CollectLocalBindReplacements(ctx, n.Body)
+	case *ast.DesugaredObject:
+		for i, b := range n.Locals {
+			collectBind(ctx, &n.Locals[i], b)
+		}
+
+		for _, child := range parser.Children(node) {
+			CollectLocalBindReplacements(ctx, child)
+		}
+	case *ast.Object:
+		for i, f := range n.Fields {
+			if f.Kind == ast.ObjectLocal {
+				// the field location starts at the bind name like the location of a local bind
+				collectBind(ctx, &n.Fields[i], ast.LocalBind{Variable: *f.Id, LocRange: f.LocRange})
+			}
+		}
+
+		for _, child := range parser.Children(node) {
+			CollectLocalBindReplacements(ctx, child)
+		}
+	default:
+		for _, child := range parser.Children(node) {
+			CollectLocalBindReplacements(ctx, child)
+		}
+	}
+}
+
+// Run the first pass collecting the binds the options select to be prefixed
+func collectLocalBinds(ctx *Context, node ast.Node) {
+	if ctx.opts.OnlyExported {
+		collectTopLevelBinds(ctx, node)
+	} else {
+		CollectLocalBindReplacements(ctx, node)
+	}
+}
+
+// Collect the replacements prefixing only the binds of the locals at the root of the file,
+// those the rest of the file is evaluated in, for Options.OnlyExported
+func collectTopLevelBinds(ctx *Context, node ast.Node) {
+	for {
+		n, ok := node.(*ast.Local)
+		if !ok {
+			return
+		}
+
+		for i := range n.Binds {
+			collectBind(ctx, &n.Binds[i], n.Binds[i])
+		}
+
+		node = n.Body
+	}
+}
+
+// Identifiers bound at one level of nesting, mapped to the binding collected to be
+// prefixed or nil for binds that are never prefixed such as function parameters
+type scope map[string]*binding
+
+func pushScope(ctx *Context, s scope) {
+	ctx.scopes = append(ctx.scopes, s)
+}
+
+func popScope(ctx *Context) {
+	ctx.scopes = ctx.scopes[:len(ctx.scopes)-1]
+}
+
+// Resolve the identifier to the local bind collected to be prefixed that it refers to,
+// looking it up from the innermost scope outwards, nil if it isn't prefixed. The index of
+// the scope binding it is returned as well, -1 when no scope does
+func resolveLocalBind(ctx *Context, id string) (*binding, int) {
+	for i := len(ctx.scopes) - 1; i >= 0; i-- {
+		if b, ok := ctx.scopes[i][id]; ok {
+			return b, i
+		}
+	}
+
+	return nil, -1
+}
+
+// Check that renaming the variable keeps it resolving to the same bind, the scopes inside
+// the one binding it must neither bind its new name without prefixing it, nor rename
+// another bind to the name of a variable that isn't prefixed
+func checkVarCollision(ctx *Context, n *ast.Var, b *binding, level int) {
+	for _, s := range ctx.scopes[level+1:] {
+		if b != nil {
+			if other, ok := s[b.newName]; ok && other == nil {
+				ctx.collide(VarUsage, string(n.Id), *n.Loc(), "its new name %q is bound around it by a bind that isn't prefixed", b.newName)
+				return
+			}
+			continue
+		}
+
+		for _, other := range s {
+			if other != nil && other.newName == string(n.Id) {
+				ctx.collide(VarUsage, string(n.Id), *n.Loc(), "it isn't prefixed but the bind %q around it is renamed to the same name", other.name)
+				return
+			}
+		}
+	}
+}
+
+// Check that no bind of a local is renamed to the name of another one of its binds that
+// isn't prefixed, which would be bound twice
+func checkBindCollisions(ctx *Context, binds ast.LocalBinds, s scope) {
+	for _, b := range binds {
+		renamed := s[string(b.Variable)]
+		if renamed == nil {
+			continue
+		}
+
+		if other, ok := s[renamed.newName]; ok && other == nil {
+			ctx.collide(LocalBind, string(b.Variable), bindLocation(b), "its new name %q is the name of another bind of the same local that isn't prefixed", renamed.newName)
+		}
+	}
+}
+
+// Visit the bodies of object fields, with the object locals already in scope
+func collectFieldVarReplacements(ctx *Context, fields ast.ObjectFields) {
+	for _, f := range fields {
+		// a method keeps its body on the function so it is visited with its parameters in scope
+		if f.Method != nil {
+			CollectVarReplacements(ctx, f.Method)
+			continue
+		}
+		if f.Expr2 != nil {
+			CollectVarReplacements(ctx, f.Expr2)
+		}
+		if f.Expr3 != nil {
+			CollectVarReplacements(ctx, f.Expr3)
+		}
+	}
+}
+
+// Visit the for specs of a comprehension from the outermost in, each spec's expression
+// sees the variables of the specs before it while its conditions also see its own variable.
+// The loop variables are pushed as scopes for the comprehension body and are never prefixed,
+// returns the number of scopes pushed for the caller to pop once the body is visited.
+func collectForSpecVarReplacements(ctx *Context, spec *ast.ForSpec) int {
+	// the spec given is the innermost, each pointing to the one before it
+	var specs []*ast.ForSpec
+	for ; spec != nil; spec = spec.Outer {
+		specs = append([]*ast.ForSpec{spec}, specs...)
+	}
+
+	for _, spec := range specs {
+		CollectVarReplacements(ctx, spec.Expr)
+		pushScope(ctx, scope{string(spec.VarName): nil})
+
+		for _, cond := range spec.Conditions {
+			CollectVarReplacements(ctx, cond.Expr)
+		}
+	}
+
+	return len(specs)
+}
+
+// Second pass, collect the replacements prefixing the variables under node that resolve to
+// a local bind collected by CollectLocalBindReplacements, which must have run first
+func CollectVarReplacements(ctx *Context, node ast.Node) {
+	switch n := node.(type) {
+	case *ast.Var:
+		// only references to binds are vars, a field access `o.x` desugars to an index by the
+		// string literal "x" and field names are literals too, so a field that shares its name
+		// with a local is never renamed. `self` and `super` are their own nodes and never reach
+		// here, `$` is a var bound by desugaring to the outermost object and `std` is only
+		// renamed when a local shadows it
+		if n.Id == "$" {
+			break
+		}
+		b, level := resolveLocalBind(ctx, string(n.Id))
+		checkVarCollision(ctx, n, b, level)
+		if b != nil {
+			b.used = true
+			rep, err := collectVarReplacement(ctx, n, string(n.Id), b.newName)
+			if err != nil {
+				ctx.fail(VarUsage, string(n.Id), *n.Loc(), err)
+				break
+			}
+			ctx.Replacements = append(ctx.Replacements, *rep)
+		}
+	case *ast.Local:
+		// binds are visible in each other's bodies as well as in the body of the local
+		s := make(scope)
+		for i, b := range n.Binds {
+			s[string(b.Variable)] = ctx.localBinds[&n.Binds[i]]
+		}
+		checkBindCollisions(ctx, n.Binds, s)
+
+		pushScope(ctx, s)
+		defer popScope(ctx)
+
+		for _, b := range n.Binds {
+			// a bind using the function sugar `local f(x) = ...` keeps its parameters on the bind
+			// before desugaring, visit it as a function so the parameters shadow the outer scope
+			if b.Fun != nil {
+				CollectVarReplacements(ctx, b.Fun)
+			} else {
+				CollectVarReplacements(ctx, b.Body)
+			}
+		}
+
+		CollectVarReplacements(ctx, n.Body)
+
+		return
+	case *ast.Function:
+		// parameters shadow outer binds of the same name, they are never prefixed, this also
+		// covers comprehensions which desugar to std.flatMap over a function of the loop variable
+		s := make(scope)
+		for _, p := range n.Parameters {
+			s[string(p.Name)] = nil
+		}
+
+		pushScope(ctx, s)
+		defer popScope(ctx)
+
+		// default arguments are evaluated inside the function, so like the body they see
+		// the parameters first and the outer scope for every other name
+		for _, p := range n.Parameters {
+			if p.DefaultArg != nil {
+				CollectVarReplacements(ctx, p.DefaultArg)
+			}
+		}
+
+		CollectVarReplacements(ctx, n.Body)
+
+		return
+	case *ast.DesugaredObject:
+		// field names are evaluated outside of the object so its locals aren't visible to them
+		for _, f := range n.Fields {
+			CollectVarReplacements(ctx, f.Name)
+		}
+
+		// object locals are visible in each other's bodies, every field body and assertion
+		s := make(scope)
+		for i, b := range n.Locals {
+			s[string(b.Variable)] = ctx.localBinds[&n.Locals[i]]
+		}
+		checkBindCollisions(ctx, n.Locals, s)
+
+		pushScope(ctx, s)
+		defer popScope(ctx)
+
+		for _, b := range n.Locals {
+			CollectVarReplacements(ctx, b.Body)
+		}
+		for _, f := range n.Fields {
+			CollectVarReplacements(ctx, f.Body)
+		}
+		for _, a := range n.Asserts {
+			CollectVarReplacements(ctx, a)
+		}
+
+		return
+	case *ast.Object:
+		// same scoping as a desugared object, where locals are fields of kind ObjectLocal
+		for _, f := range n.Fields {
+			if f.Expr1 != nil {
+				CollectVarReplacements(ctx, f.Expr1)
+			}
+		}
+
+		s := make(scope)
+		for i, f := range n.Fields {
+			if f.Kind == ast.ObjectLocal {
+				s[string(*f.Id)] = ctx.localBinds[&n.Fields[i]]
+			}
+		}
+
+		pushScope(ctx, s)
+		defer popScope(ctx)
+
+		collectFieldVarReplacements(ctx, n.Fields)
+
+		return
+	case *ast.ArrayComp:
+		pushed := collectForSpecVarReplacements(ctx, &n.Spec)
+		defer func() { ctx.scopes = ctx.scopes[:len(ctx.scopes)-pushed] }()
+
+		CollectVarReplacements(ctx, n.Body)
+
+		return
+	case *ast.ObjectComp:
+		pushed := collectForSpecVarReplacements(ctx, &n.Spec)
+		defer func() { ctx.scopes = ctx.scopes[:len(ctx.scopes)-pushed] }()
+
+		// unlike a plain object the field name sees the loop variables
+		for _, f := range n.Fields {
+			if f.Expr1 != nil {
+				CollectVarReplacements(ctx, f.Expr1)
+			}
+		}
+
+		s := make(scope)
+		for i, f := range n.Fields {
+			if f.Kind == ast.ObjectLocal {
+				s[string(*f.Id)] = ctx.localBinds[&n.Fields[i]]
+			}
+		}
+
+		pushScope(ctx, s)
+		defer popScope(ctx)
+
+		collectFieldVarReplacements(ctx, n.Fields)
+
+		return
+	}
+
+	for _, child := range parser.Children(node) {
+		CollectVarReplacements(ctx, child)
+	}
+}
+
+// Get the local binds collected to be prefixed that no variable resolved to in the variable
+// pass, sorted by location
+func unusedBinds(ctx *Context) []Rename {
+	var unused []Rename
+	for _, b := range ctx.localBinds {
+		if !b.used {
+			loc := ctx.location(b.offset)
+			unused = append(unused, Rename{ctx.Filename, b.name, b.newName, loc.Line, loc.Column, LocalBind})
+		}
+	}
+
+	sort.Slice(unused, func(i, j int) bool {
+		return unused[i].Line < unused[j].Line || unused[i].Line == unused[j].Line && unused[i].Column < unused[j].Column
+	})
+
+	return unused
+}
+
+// Pass after CollectVarReplacements with Options.KeepAliases, collect the insertions binding the original names
+// of the prefixed binds of each local under node to their prefixed names, at the start of
+// the body of the local where the binds are in scope. Each local gets its own alias
+// local inside the expression of the file, so aliases never clash with each other or leak
+// into other files, and a name is only aliased where it already referred to the bind
+func CollectAliasReplacements(ctx *Context, node ast.Node) {
+	if n, ok := node.(*ast.Local); ok {
+		var aliases []string
+		for i, b := range n.Binds {
+			if bind := ctx.localBinds[&n.Binds[i]]; bind != nil {
+				aliases = append(aliases, string(b.Variable)+" = "+bind.newName)
+			}
+		}
+
+		switch loc := n.Body.Loc(); {
+		case len(aliases) == 0:
+		case !loc.IsSet():
+			ctx.debugf("aliases %s: no location", strings.Join(aliases, ", "))
+		default:
+			offset := ctx.offset(loc.Begin.Line-1, loc.Begin.Column-1)
+
+			// keep the body on a line of its own with its indentation when it starts one
+			sep := " "
+			if indent := ctx.Source[ctx.offset(loc.Begin.Line-1, 0):offset]; len(bytes.TrimLeft(indent, " \t")) == 0 {
+				sep = "\n" + string(indent)
+			}
+
+			ctx.debugf("aliases at %v: %s", &loc.Begin, strings.Join(aliases, ", "))
+			alias := "local " + strings.Join(aliases, ", ") + ";" + sep
+			ctx.Replacements = append(ctx.Replacements, Replacement{offset, offset, alias, "", Alias})
+		}
+	}
+
+	for _, child := range parser.Children(node) {
+		CollectAliasReplacements(ctx, child)
+	}
+}
+
+// Apply the replacements of the context to a copy of its source
+func ApplyReplacements(ctx *Context) ([]byte, error) {
+	out, _, err := applyReplacements(ctx)
+	return out, err
+}
+
+// Apply the replacements like ApplyReplacements, also mapping each unchanged gap and
+// each replacement in the result back to where it begins in the source
+func applyReplacements(ctx *Context) ([]byte, []mapping, error) {
+	reps := ctx.Replacements
+
+	// Sort replacements by beginOffset ascending so the source is streamed through once, an
+	// insertion goes before a replacement beginning at the same offset
+	sort.SliceStable(reps, func(i, j int) bool {
+		return reps[i].BeginOffset < reps[j].BeginOffset ||
+			reps[i].BeginOffset == reps[j].BeginOffset && reps[i].EndOffset < reps[j].EndOffset
+	})
+
+	// overlapping replacements mean the collection passes are broken, applying them would corrupt the output
+	for i := 1; i < len(reps); i++ {
+		if prev, rep := reps[i-1], reps[i]; rep.BeginOffset < prev.EndOffset {
+			prevBegin, prevEnd := ctx.location(prev.BeginOffset), ctx.location(prev.EndOffset)
+			begin, end := ctx.location(rep.BeginOffset), ctx.location(rep.EndOffset)
+			return nil, nil, fmt.Errorf("%s: overlapping replacements %q at %v-%v and %q at %v-%v", ctx.Filename,
+				prev.NewValue, &prevBegin, &prevEnd, rep.NewValue, &begin, &end)
+		}
+	}
+
+	size := len(ctx.Source)
+	for _, rep := range reps {
+		size += len(rep.NewValue) - (rep.EndOffset - rep.BeginOffset)
+	}
+
+	// Copy the unchanged gaps between replacements and insert the new values into a
+	// single buffer, never writing to the backing array of ctx.Source
+	out := make([]byte, 0, size)
+	var mappings []mapping
+	last := 0
+	for _, rep := range reps {
+		if rep.BeginOffset > last {
+			mappings = append(mappings, ctx.mapping(len(out), last))
+			out = append(out, ctx.Source[last:rep.BeginOffset]...)
+		}
+		mappings = append(mappings, ctx.mapping(len(out), rep.BeginOffset))
+		out = append(out, rep.NewValue...)
+		last = rep.EndOffset
+	}
+	if len(ctx.Source) > last {
+		mappings = append(mappings, ctx.mapping(len(out), last))
+		out = append(out, ctx.Source[last:]...)
+	}
+
+	return out, mappings, nil
+}
+
+// Name used in place of a file name when the source is read from stdin
+const stdinName = "<stdin>"
+
+// Read the source code from the given path, or from stdin if the path is "-"
+func readSource(input string) (string, []byte, error) {
+	if input == "-" {
+		code, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", nil, err
+		}
+
+		return stdinName, code, nil
+	}
+
+	code, err := os.ReadFile(input)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return input, code, nil
+}
+
+// UTF-8 byte order mark some editors, mostly on Windows, write at the start of files
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// Create the context for processing a single file. A leading byte order mark is dropped as
+// the lexer can't handle it and the offsets must match the locations it reports
+func newContext(source string, code []byte, prefix string, opts *Options, imports *importState) *Context {
+	raw := code
+	code = bytes.TrimPrefix(code, utf8BOM)
+
+	return &Context{
+		Filename:    source,
+		Prefix:      prefix,
+		opts:        opts,
+		Source:      code,
+		raw:         raw,
+		LineOffsets: buildLineOffsets(code),
+		localBinds:  make(map[any]*binding),
+		imports:     imports,
+		importing:   []string{source},
+	}
+}
+
+// Create the context for bundling the source of a file held in memory on its own, with a
+// prefix derived from the options, for running the collection passes individually
+func NewContext(source []byte, filename string, opts Options) (*Context, error) {
+	prefix, err := opts.filePrefix(filename, 0, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return newContext(filename, source, prefix, &opts, newImportState(&opts)), nil
+}
+
+// Parse the source of the context into the AST the collection passes walk
+func Parse(ctx *Context) (ast.Node, error) {
+	return parse(ctx)
+}
+
+// Parse the source and collect all replacements needed to prefix its local binds
+func Collect(ctx *Context) error {
+	sites, err := collectLocals(ctx)
+	if err != nil {
+		return err
+	}
+	ctx.imports.addBinds(ctx)
+
+	// Third pass to record imports and, with --inline-imports, replace them with the bundled source of the imported files
+	return collectImports(ctx, sites)
+}
+
+// Parse the file and collect the replacements of its local binds and variables, only
+// touching the context and Options.Cache so input files can be collected concurrently.
+// Returns the imports found for the third pass
+func collectLocals(ctx *Context) ([]importSite, error) {
+	key := cacheKey(ctx)
+	if entry, ok := ctx.opts.Cache.get(key); ok {
+		ctx.debugf("cache hit for %s", ctx.Filename)
+		entry.restore(ctx)
+		return entry.Imports, nil
+	}
+
+	// an empty file or one with only comments isn't an expression to parse, nothing to rename
+	if !hasCode(ctx.Source) {
+		ctx.debugf("%s has no code", ctx.Filename)
+		return nil, nil
+	}
+
+	node, err := parse(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// the wrap strategy keeps the file as is, its locals are already scoped to the
+	// parenthesized expression it is bound to
+	if ctx.opts.Strategy != StrategyWrap {
+		// First pass to collect and replace local binds
+		collectLocalBinds(ctx, node)
+		// Second pass to collect and replace variable usages
+		CollectVarReplacements(ctx, node)
+
+		if ctx.opts.KeepAliases {
+			CollectAliasReplacements(ctx, node)
+		}
+
+		ctx.Unused = unusedBinds(ctx)
+	}
+
+	if ctx.opts.StripLeadingComments {
+		collectLeadingCommentReplacement(ctx)
+	}
+
+	sites := collectImportSites(node)
+	if err := ctx.opts.Cache.put(key, newCacheEntry(ctx, sites)); err != nil {
+		ctx.debugf("caching %s: %v", ctx.Filename, err)
+	}
+
+	return sites, nil
+}
+
+// Collect the replacement removing the comments before the first token of the file, along
+// with the whitespace around them, keeping a leading "#!" line
+func collectLeadingCommentReplacement(ctx *Context) {
+	src := ctx.Source
+
+	begin := 0
+	if bytes.HasPrefix(src, []byte("#!")) {
+		begin = len(src)
+		if i := bytes.IndexByte(src, '\n'); i >= 0 {
+			begin = i + 1
+		}
+	}
+
+	end := begin
+	for {
+		rest := src[end:]
+		trimmed := bytes.TrimLeft(rest, " \t\r\n")
+		end += len(rest) - len(trimmed)
+
+		switch {
+		case bytes.HasPrefix(trimmed, []byte("//")) || bytes.HasPrefix(trimmed, []byte("#")):
+			if i := bytes.IndexByte(trimmed, '\n'); i >= 0 {
+				end += i + 1
+			} else {
+				end = len(src)
+			}
+		case bytes.HasPrefix(trimmed, []byte("/*")):
+			i := bytes.Index(trimmed[2:], []byte("*/"))
+			if i < 0 {
+				// left for the parser to report
+				return
+			}
+			end += 2 + i + 2
+		default:
+			if end > begin && bytes.ContainsAny(src[begin:end], "/#") {
+				ctx.Replacements = append(ctx.Replacements, Replacement{begin, end, "", string(src[begin:end]), Comment})
+			}
+			return
+		}
+	}
+}
+
+// Check whether the source has any code, not only whitespace and comments
+func hasCode(source []byte) bool {
+	// leave errors to the parser, the end of file is always the last token
+	tokens, err := parser.Lex("", "", string(source))
+	return err != nil || len(tokens) > 1
+}
+
+// Parse the source of the context, the bytes already read rather than the file on disk so
+// the AST locations always match the offsets computed from Source
+func parse(ctx *Context) (ast.Node, error) {
+	// Create Jsonnet VM and parse the input file as AST for accurate location info, the
+	// desugared AST is only available by importing, serve the source under its name
+	vm := ctx.imports.vms.get(&jsonnet.MemoryImporter{
+		Data: map[string]jsonnet.Contents{ctx.Filename: jsonnet.MakeContents(string(ctx.Source))},
+	})
+	defer ctx.imports.vms.put(vm)
+
+	node, _, err := vm.ImportAST("", ctx.Filename)
+	if err != nil {
+		return nil, &ParseError{ctx.Filename, err}
+	}
+
+	return node, nil
+}
+
+// A file that couldn't be parsed, the go-jsonnet error has the location of the problem
+type ParseError struct {
+	Filename string
+	Err      error
+}
+
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Collect the local binds and variables of every input with a pool of workers bounded
+// by GOMAXPROCS, each file parsed with its own VM since it isn't safe for concurrent use,
+// returning the imports found and errors in input order
+func collectInputs(contexts []*Context) ([][]importSite, []error) {
+	sites := make([][]importSite, len(contexts))
+	errs := make([]error, len(contexts))
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(runtime.GOMAXPROCS(0), len(contexts)) {
+		wg.Go(func() {
+			for i := range jobs {
+				sites[i], errs[i] = collectLocals(contexts[i])
+			}
+		})
+	}
+
+	for i := range contexts {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return sites, errs
+}
+
+// Get a copy of the collected replacements in source order
+func sortedReplacements(ctx *Context) []Replacement {
+	reps := make([]Replacement, len(ctx.Replacements))
+	copy(reps, ctx.Replacements)
+
+	sort.Slice(reps, func(i, j int) bool {
+		return reps[i].BeginOffset < reps[j].BeginOffset
+	})
+
+	return reps
+}
+
+// Print each collected replacement in source order, used by --dry-run
+func printReplacements(w io.Writer, source string, ctx *Context) {
+	for _, rep := range sortedReplacements(ctx) {
+		fmt.Fprintf(w, "%s:%d-%d: %q -> %q\n", source, rep.BeginOffset, rep.EndOffset, ctx.Source[rep.BeginOffset:rep.EndOffset], rep.NewValue)
+	}
+}
+
+// Bundle the source of a single file held in memory, filename is used to derive its
+// prefix and in messages, imports are still resolved from disk
+func Bundle(source []byte, filename string, opts Options) ([]byte, error) {
+	out, _, err := BundleReport(source, filename, opts)
+	return out, err
+}
+
+// List the local binds of the source that bundling it would prefix without bundling it, as
+// renames from the original names to the prefixed ones in source order. Only the first pass
+// runs so the list matches what is renamed, binds that can't be renamed are reported like
+// when bundling
+func Locals(source []byte, filename string, opts Options) ([]Rename, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	ctx, err := NewContext(source, filename, opts)
+	if err != nil {
+		return nil, err
+	}
+	if !hasCode(source) || opts.Strategy == StrategyWrap {
+		return nil, nil
+	}
+
+	node, err := parse(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	collectLocalBinds(ctx, node)
+	if err := reportFailures(ctx); err != nil {
+		return nil, err
+	}
+
+	return renames(ctx), nil
+}
+
+// Bundle like Bundle and also report every rename applied, to the file and to the
+// files inlined into it, each file's renames in source order
+func BundleReport(source []byte, filename string, opts Options) ([]byte, []Rename, error) {
+	if err := opts.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	ctx, err := NewContext(source, filename, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out, err := bundle([]*Context{ctx}, &opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return out, ctx.imports.renames, nil
+}
+
+// Bundle the source read from r and write the result to w, the source is read in full
+// before bundling since replacements are located by offsets into the whole source
+func BundleStream(r io.Reader, w io.Writer, filename string, opts Options) error {
+	source, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", filename, err)
+	}
+
+	out, err := Bundle(source, filename, opts)
+	if err != nil {
+		return fmt.Errorf("bundling %s: %w", filename, err)
+	}
+
+	if _, err := w.Write(out); err != nil {
+		return fmt.Errorf("writing %s: %w", filename, err)
+	}
+
+	return nil
+}
+
+// Bundle each input file, or stdin for "-", with its own prefix and concatenate the results
+func BundleFiles(inputs []string, opts Options) ([]byte, error) {
+	out, _, err := BundleFilesDeps(inputs, opts)
+	return out, err
+}
+
+// Bundle like BundleFiles and also get the absolute paths of the files the bundle depends on,
+// the inputs and the files they import, transitively with Options.InlineImports. The
+// files are returned on error as well, as far as they were discovered
+func BundleFilesDeps(inputs []string, opts Options) ([]byte, []string, error) {
+	if err := opts.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	var contexts []*Context
+
+	// imported files are shared by all inputs so each is only processed once
+	imports := newImportState(&opts)
+
+	// the inputs are dependencies even when they fail to read or parse
+	for _, input := range inputs {
+		if input != "-" {
+			imports.canonical(input)
+		}
+	}
+
+	for i, input := range inputs {
+		source, code, err := readSource(input)
+		if err != nil {
+			return nil, imports.files(), err
+		}
+
+		prefix, err := opts.filePrefix(source, i, len(inputs))
+		if err != nil {
+			return nil, imports.files(), err
+		}
+
+		contexts = append(contexts, newContext(source, code, prefix, &opts, imports))
+	}
+
+	out, err := bundle(contexts, &opts)
+
+	return out, imports.files(), err
+}
+
+// Process the contexts of the input files, sharing the same import state, and concatenate the results
+func bundle(contexts []*Context, opts *Options) ([]byte, error) {
+	var sources, prefixes []string
+	var sections []*Context
+	var out, lead []byte
+	var mappings, leadMappings []mapping
+
+	imports := contexts[0].imports
+
+	for _, ctx := range contexts {
+		prefix, err := imports.claimPrefix(ctx.Prefix, ctx.Filename, opts.namedPrefixes())
+		if err != nil {
+			return nil, err
+		}
+		ctx.Prefix = prefix
+
+		// an input imported by another is inlined from the bytes already read for it
+		if ctx.Filename != stdinName {
+			imports.importer.add(ctx.Filename, ctx.Source)
+			if opts.Manifest != nil {
+				imports.sums[canonicalPath(ctx.Filename)] = sha256.Sum256(ctx.raw)
+			}
+		}
+	}
+
+	// inputs are independent until their imports, collect them concurrently and then
+	// resolve the imports sharing the import state in input order
+	sites, errs := collectInputs(contexts)
+	for _, ctx := range contexts {
+		imports.addBinds(ctx)
+	}
+
+	var skipped []error
+	var skippedNames []string
+	for i, ctx := range contexts {
+		err := errs[i]
+
+		// one broken file of many doesn't keep the others from being bundled unless strict
+		var perr *ParseError
+		if len(contexts) > 1 && !opts.Strict && errors.As(err, &perr) {
+			skipped, skippedNames = append(skipped, err), append(skippedNames, ctx.Filename)
+			continue
+		}
+
+		if err == nil {
+			err = collectImports(ctx, sites[i])
+		}
+		if err == nil {
+			err = reportFailures(ctx)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ctx.Filename, err)
+		}
+
+		if opts.DryRun {
+			printReplacements(os.Stderr, ctx.Filename, ctx)
+			continue
+		}
+
+		sections = append(sections, ctx)
+	}
+
+	if len(skipped) > 0 {
+		if len(skipped) == len(contexts) {
+			return nil, fmt.Errorf("none of the %d files could be parsed:\n%w", len(contexts), errors.Join(skipped...))
+		}
+		for _, err := range skipped {
+			log.Printf("warning: %v", err)
+		}
+		log.Printf("warning: %d of %d files skipped as they could not be parsed: %s",
+			len(skipped), len(contexts), strings.Join(skippedNames, ", "))
+	}
+
+	// files imported by other inputs must come before them
+	sections = sortSections(sections, imports)
+
+	// the fields of an object don't depend on their order, keep them sorted by name
+	object := opts.Strategy == StrategyObject
+	if object {
+		slices.SortStableFunc(sections, func(a, b *Context) int {
+			return strings.Compare(opts.headerPath(a.Filename), opts.headerPath(b.Filename))
+		})
+	}
+
+	for _, ctx := range sections {
+		// Apply all collected replacements to the source code
+		newSource, sourceMappings, err := applyReplacements(ctx)
+		if err != nil {
+			return nil, err
+		}
+		imports.renames = append(imports.renames, renames(ctx)...)
+		imports.edits = append(imports.edits, edits(ctx)...)
+
+		// a shebang or other leading comments of the first section stay at the very top,
+		// lift them out before anything is inserted above them
+		if len(sources) == 0 {
+			if n := leadingLength(newSource, opts.PreserveLeading); n > 0 {
+				lead, leadMappings = newSource[:n:n], []mapping{ctx.mapping(0, 0)}
+				if lead[n-1] != '\n' {
+					lead = append(lead, '\n')
+				}
+				newSource, sourceMappings = newSource[n:], afterLeading(ctx, sourceMappings, n)
+			}
+		}
+
+		locals, sectionMappings, err := inlinedLocals(ctx)
+		if err != nil {
+			return nil, err
+		}
+		sectionMappings = append(sectionMappings, shift(sourceMappings, len(locals))...)
+
+		sources = append(sources, opts.headerPath(ctx.Filename))
+		prefixes = append(prefixes, ctx.Prefix)
+
+		section := append(locals, newSource...)
+
+		// each section is a jsonnet expression of its own, format them separately and
+		// without the header and section comments so those are kept exactly as rendered.
+		// A section without code is written as is, it can't be parsed or evaluated
+		empty := !hasCode(section)
+		if opts.Format && !empty {
+			formatted, err := formatter.Format(ctx.Filename, string(section), formatter.DefaultOptions())
+			if err != nil {
+				return nil, fmt.Errorf("%s: formatting bundle: %w", ctx.Filename, err)
+			}
+			section = []byte(formatted)
+		}
+
+		// catch replacements that broke the syntax before the bundle is written anywhere
+		if opts.Verify && !empty {
+			if _, err := jsonnet.SnippetToAST(ctx.Filename, string(section)); err != nil {
+				return nil, fmt.Errorf("%s: bundle is not valid jsonnet: %w", ctx.Filename, err)
+			}
+		}
+
+		if opts.CheckEval && !empty {
+			if err := checkEval(ctx, section); err != nil {
+				return nil, fmt.Errorf("%s: %w", ctx.Filename, err)
+			}
+		}
+
+		// a single file is written as is, multiple files get a comment separating each
+		// section, and with the object strategy each section is bound to its prefix outside
+		// of the object, where `$` in the file still refers to its own outermost object
+		switch {
+		case object:
+			mappings = append(mappings, generated(len(out)))
+			out = append(out, "local "+ctx.Prefix+" = (\n"...)
+		case len(contexts) > 1:
+			mappings = append(mappings, generated(len(out)))
+			if len(out) > 0 {
+				out = append(out, '\n')
+			}
+			out = append(out, "// "+opts.headerPath(ctx.Filename)+"\n"...)
+		}
+		mappings = append(mappings, shift(sectionMappings, len(out))...)
+		out = append(out, section...)
+
+		if object {
+			// the closing parenthesis can't follow a line comment, a file without code
+			// still needs a value
+			if len(section) > 0 && section[len(section)-1] != '\n' {
+				out = append(out, '\n')
+			}
+			mappings = append(mappings, generated(len(out)))
+			if empty {
+				out = append(out, "null\n"...)
+			}
+			out = append(out, ");\n"...)
+		}
+	}
+
+	if object {
+		mappings = append(mappings, generated(len(out)))
+		out = append(out, "{\n"...)
+		for _, ctx := range sections {
+			out = append(out, "  '"+parser.StringEscape(opts.headerPath(ctx.Filename), true)+"': "+ctx.Prefix+",\n"...)
+		}
+		out = append(out, "}\n"...)
+	}
+
+	if opts.Header {
+		banner, err := header(opts, sources, prefixes)
+		if err != nil {
+			return nil, err
+		}
+
+		// add comment to the top of the file indicating it is auto-generated
+		mappings = append([]mapping{generated(0)}, shift(mappings, len(banner))...)
+		out = append([]byte(banner), out...)
+	}
+
+	if len(lead) > 0 {
+		mappings = append(leadMappings, shift(mappings, len(lead))...)
+		out = append(lead, out...)
+	}
+
+	// end with a single newline whatever the last file ends with, so editors adding or
+	// removing the final newline of an input don't change the bundle
+	if opts.NormalizeNewline && len(out) > 0 {
+		out = append(bytes.TrimRight(out, "\r\n"), '\n')
+		mappings = slices.DeleteFunc(mappings, func(m mapping) bool { return m.offset >= len(out) })
+	}
+
+	if opts.SourceMap != nil {
+		*opts.SourceMap = newSourceMap(out, mappings)
+	}
+
+	if opts.Manifest != nil {
+		*opts.Manifest = newManifest(imports)
+	}
+
+	if opts.Edits != nil {
+		*opts.Edits = Edits{Version: editsVersion, Edits: append([]Edit{}, imports.edits...)}
+	}
+
+	if opts.Stats != nil {
+		*opts.Stats = newStats(len(sections)+len(imports.inlined), imports.renames, out)
+	}
+
+	return out, nil
+}
+
+// Get the length of the leading lines of source kept above the header, a "#!" line and then
+// up to n line comments, they never contain a replacement
+func leadingLength(source []byte, n int) int {
+	length := 0
+	if bytes.HasPrefix(source, []byte("#!")) {
+		length = len(firstLine(source))
+	}
+
+	for range n {
+		line := firstLine(source[length:])
+
+		trimmed := bytes.TrimSpace(line)
+		if len(trimmed) == 0 || !(trimmed[0] == '#' || bytes.HasPrefix(trimmed, []byte("//"))) {
+			break
+		}
+
+		length += len(line)
+	}
+
+	return length
+}
+
+// Get the first line of source along with its newline, if it has one
+func firstLine(source []byte) []byte {
+	if end := bytes.IndexByte(source, '\n'); end >= 0 {
+		return source[:end+1]
+	}
+
+	return source
+}
+
+// Drop the mappings of the first n bytes of a section, mapping what follows to its start
+func afterLeading(ctx *Context, mappings []mapping, n int) []mapping {
+	out := []mapping{ctx.mapping(0, n)}
+	for _, m := range mappings {
+		if m.offset > n {
+			m.offset -= n
+			out = append(out, m)
+		}
+	}
+
+	return out
+}
+
+// Render the header comment of a bundle of the sources with the prefixes
+func header(opts *Options, sources []string, prefixes []string) (string, error) {
+	timestamp := opts.HeaderTime
+	if timestamp == "" {
+		t, err := buildTime()
+		if err != nil {
+			return "", err
+		}
+		timestamp = t.Format(time.RFC3339)
+	}
+
+	return renderHeader(opts.HeaderTemplate, headerData{
+		Source: strings.Join(sources, ", "),
+		Time:   timestamp,
+		Prefix: strings.Join(prefixes, ", "),
+	})
+}
+
+// Evaluate the original source of the context and its bundled section, failing unless both
+// evaluate to the same JSON. Both are evaluated as the file itself so imports the bundle
+// still has resolve relative to it the same way
+func checkEval(ctx *Context, section []byte) error {
+	want, err := evaluate(ctx, ctx.Source)
+	if err != nil {
+		return fmt.Errorf("evaluating original: %w", err)
+	}
+
+	got, err := evaluate(ctx, section)
+	if err != nil {
+		return fmt.Errorf("evaluating bundle: %w", err)
+	}
+
+	if got != want {
+		return fmt.Errorf("bundle evaluates differently from the original")
+	}
+
+	return nil
+}
+
+// Evaluate the source in place of the file of the context, with the inputs of the bundle
+// imported from the bytes already read like when inlining
+func evaluate(ctx *Context, source []byte) (string, error) {
+	files := &sourceImporter{Importer: ctx.imports.importer, sources: make(map[string]jsonnet.Contents)}
+	files.add(ctx.Filename, source)
+
+	vm := ctx.imports.vms.get(files)
+	defer ctx.imports.vms.put(vm)
+
+	return vm.EvaluateFile(ctx.Filename)
+}
+
+// Default template for the header comment, used when HeaderTemplate is empty
+const DefaultHeaderTemplate = "// Auto-generated by jsonnet-bundler at {{.Time}} for {{.Source}}"
+
+// Fields available to the header template, comma separated when bundling multiple files
+type headerData struct {
+	// the input file names
+	Source string
+	// the build time formatted as RFC3339
+	Time string
+	// the prefixes used to namespace each file
+	Prefix string
+}
+
+// Render the header comment from the template text, the default template when empty
+func renderHeader(text string, data headerData) (string, error) {
+	if text == "" {
+		text = DefaultHeaderTemplate
+	}
+
+	tmpl, err := template.New("header").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid header template: %w", err)
+	}
+
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("invalid header template: %w", err)
+	}
+
+	// make sure the source starts on its own line
+	banner := buf.String()
+	if !strings.HasSuffix(banner, "\n") {
+		banner += "\n"
+	}
+
+	return banner, nil
+}
+
+// Get the time recorded in the header, taken from SOURCE_DATE_EPOCH when set
+// so that builds are reproducible, see https://reproducible-builds.org/specs/source-date-epoch/
+func buildTime() (time.Time, error) {
+	epoch, ok := os.LookupEnv("SOURCE_DATE_EPOCH")
+	if !ok {
+		return time.Now(), nil
+	}
+
+	sec, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %w", epoch, err)
+	}
+
+	return time.Unix(sec, 0).UTC(), nil
+}
@@ -0,0 +1,1050 @@
+package bundler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/go-jsonnet"
+	"github.com/google/go-jsonnet/ast"
+)
+
+// Evaluate the source in place of the file of the given name, its imports resolve
+// relative to it from disk
+func evalJSON(t testing.TB, filename string, source []byte) string {
+	t.Helper()
+
+	files := &sourceImporter{Importer: &jsonnet.FileImporter{}, sources: make(map[string]jsonnet.Contents)}
+	files.add(filename, source)
+
+	vm := jsonnet.MakeVM()
+	vm.Importer(files)
+
+	out, err := vm.EvaluateFile(filename)
+	if err != nil {
+		t.Fatalf("evaluating %s: %v\n%s", filename, err, source)
+	}
+
+	return out
+}
+
+// Bundle the source and check that the bundle evaluates to the same JSON as the original,
+// returning the bundle
+func roundTrip(t testing.TB, filename string, source string, opts Options) string {
+	t.Helper()
+
+	want := evalJSON(t, filename, []byte(source))
+
+	out, err := Bundle([]byte(source), filename, opts)
+	if err != nil {
+		t.Fatalf("bundling %s: %v", filename, err)
+	}
+
+	if got := evalJSON(t, filename, out); got != want {
+		t.Errorf("bundle evaluates to %s, want %s\n%s", got, want, out)
+	}
+
+	return string(out)
+}
+
+// Write the files, by slash separated path, into a temporary directory and return it
+func writeFiles(t testing.TB, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+// Sources bundled with the prefix "p", want is the expected bundle when not empty,
+// otherwise the bundle only has to evaluate like the source
+var roundTripTests = []struct {
+	name   string
+	source string
+	want   string
+}{
+	{
+		name:   "locals",
+		source: "local x = 1, y = x + 1;\nlocal z = y * 2;\n[x, y, z]\n",
+		want:   "local p_x = 1, p_y = p_x + 1;\nlocal p_z = p_y * 2;\n[p_x, p_y, p_z]\n",
+	},
+	{
+		name:   "nested locals",
+		source: "local a = local b = 2; b * 3;\n{ v: local c = a; c + a }\n",
+		want:   "local p_a = local p_b = 2; p_b * 3;\n{ v: local p_c = p_a; p_c + p_a }\n",
+	},
+	{
+		name:   "shadowed locals",
+		source: "local x = 1;\nlocal y = local x = 10; x + 1;\n[x, y, local x = 100; x]\n",
+		want:   "local p_x = 1;\nlocal p_y = local p_x = 10; p_x + 1;\n[p_x, p_y, local p_x = 100; p_x]\n",
+	},
+	{
+		name:   "functions",
+		source: "local inc = function(n) n + 1;\nlocal twice(f, v) = f(f(v));\n{ v: twice(inc, 1), w: (function(inc) inc * 2)(4) }\n",
+		want:   "local p_inc = function(n) n + 1;\nlocal p_twice(f, v) = f(f(v));\n{ v: p_twice(p_inc, 1), w: (function(inc) inc * 2)(4) }\n",
+	},
+	{
+		name:   "object locals",
+		source: "local base = 1;\n{\n  local half = base / 2,\n  a: half,\n  b: { local half = 3, c: half + base },\n}\n",
+		want:   "local p_base = 1;\n{\n  local p_half = p_base / 2,\n  a: p_half,\n  b: { local p_half = 3, c: p_half + p_base },\n}\n",
+	},
+	{
+		name:   "comprehensions",
+		source: "local xs = [1, 2, 3];\nlocal k = 'key';\n{\n  squares: [x * x for x in xs if x > 1],\n  byName: { [k + x]: x for x in ['a', 'b'] },\n}\n",
+		want:   "local p_xs = [1, 2, 3];\nlocal p_k = 'key';\n{\n  squares: [x * x for x in p_xs if x > 1],\n  byName: { [p_k + x]: x for x in ['a', 'b'] },\n}\n",
+	},
+	{
+		// the parameter shadows the prefixed local, its usage keeps referring to it
+		name:   "parameter shadowing a local",
+		source: "local x = 1; (function(x) x)(2)",
+		want:   "local p_x = 1; (function(x) x)(2)",
+	},
+	{
+		// default arguments see the parameters, which shadow the locals of the same names
+		name:   "default arguments",
+		source: "local y = 10, z = 1;\nlocal f(x, y=x) = x + y + z;\nlocal a = 100;\n[f(1), f(1, y), (function(a, b=a * 2) b)(3)]\n",
+		want:   "local p_y = 10, p_z = 1;\nlocal p_f(x, y=x) = x + y + p_z;\nlocal p_a = 100;\n[p_f(1), p_f(1, p_y), (function(a, b=a * 2) b)(3)]\n",
+	},
+	{
+		// an object local is in scope in every field body, including methods,
+		// hidden fields, nested objects and asserts, and in the other object locals
+		name:   "object locals used from several fields",
+		source: "{\n  local n = 2,\n  local double = n * 2,\n  assert n > 0,\n  a: double,\n  b:: [n, double],\n  c(m=n):: m + double,\n  d: { e: n, f: self.e + double },\n  g: $.c(),\n}\n",
+		want:   "{\n  local p_n = 2,\n  local p_double = p_n * 2,\n  assert p_n > 0,\n  a: p_double,\n  b:: [p_n, p_double],\n  c(m=p_n):: m + p_double,\n  d: { e: p_n, f: self.e + p_double },\n  g: $.c(),\n}\n",
+	},
+	{
+		// a comprehension variable named like a prefixed local is never renamed, the
+		// list of its own for clause still sees the local
+		name:   "comprehension variable named like a local",
+		source: "local i = 'local';\n[[i for i in [1, 2]], [[i, j] for i in [3] for j in [i]], { [k]: i for k in ['a'] for i in [i] }, i]\n",
+		want:   "local p_i = 'local';\n[[i for i in [1, 2]], [[i, j] for i in [3] for j in [i]], { [k]: i for k in ['a'] for i in [p_i] }, p_i]\n",
+	},
+	{
+		// self, super and $ are never variables to rename, whatever the locals around them
+		name:   "self super and dollar",
+		source: "local a = 1, self_ = 2;\n{ a: a, b: self.a + self_, c: $.a } + { d: super.a + a, e: { f: $.a } }\n",
+		want:   "local p_a = 1, p_self_ = 2;\n{ a: p_a, b: self.a + p_self_, c: $.a } + { d: super.a + p_a, e: { f: $.a } }\n",
+	},
+	{
+		// std is only renamed where a local shadows it
+		name:   "std",
+		source: "local n = std.length([1, 2]);\nlocal f = local std = { length(x): 42 }; std.length([]);\n[n, f, std.length([])]\n",
+		want:   "local p_n = std.length([1, 2]);\nlocal p_f = local p_std = { length(x): 42 }; p_std.length([]);\n[p_n, p_f, std.length([])]\n",
+	},
+	{
+		// multi-byte UTF-8 before a name on the same line and on earlier lines
+		name:   "non-ASCII before a local",
+		source: "// ünïcode ✓\nlocal a = '日本語'; local b = a + 'é'; { 'clé': [a, b] }\n",
+		want:   "// ünïcode ✓\nlocal p_a = '日本語'; local p_b = p_a + 'é'; { 'clé': [p_a, p_b] }\n",
+	},
+	{
+		// the last name ends the file, no trailing newline after it
+		name:   "no trailing newline",
+		source: "local x=1;x",
+		want:   "local p_x=1;p_x",
+	},
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, tt := range roundTripTests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := roundTrip(t, tt.name+".jsonnet", tt.source, Options{Prefix: "p", Strict: true})
+			if tt.want != "" && got != tt.want {
+				t.Errorf("bundle:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+// Bundle the files of a directory tree like the command does, each input with its own
+// prefix and the imports they make resolved from the tree
+func TestRoundTripFiles(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.jsonnet":       "local util = import 'lib/util.libsonnet';\nlocal name = 'main';\n{ name: name, greeting: util.greet(name) }\n",
+		"lib/util.libsonnet": "local prefix = 'hello ';\n{ greet(name):: prefix + name }\n",
+	})
+	main := filepath.Join(dir, "main.jsonnet")
+
+	want := evalJSON(t, main, mustRead(t, main))
+
+	for _, inline := range []bool{false, true} {
+		out, err := BundleFiles([]string{main}, Options{InlineImports: inline, Strict: true})
+		if err != nil {
+			t.Fatalf("inline %t: %v", inline, err)
+		}
+		if got := evalJSON(t, main, out); got != want {
+			t.Errorf("inline %t: bundle evaluates to %s, want %s\n%s", inline, got, want, out)
+		}
+	}
+}
+
+func mustRead(t testing.TB, path string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func mustContext(t testing.TB, source []byte, filename string, opts Options) *Context {
+	t.Helper()
+
+	ctx, err := NewContext(source, filename, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ctx
+}
+
+// A bind using the function sugar is renamed at its name and its usages, while its
+// parameters and their usages keep their names
+func TestFunctionSugarBind(t *testing.T) {
+	source := "local add(a, b) = a + b; add(1,2)"
+
+	got := roundTrip(t, "add.jsonnet", source, Options{Prefix: "p", Strict: true})
+	if want := "local p_add(a, b) = a + b; p_add(1,2)"; got != want {
+		t.Errorf("bundle %q, want %q", got, want)
+	}
+
+	_, renames, err := BundleReport([]byte(source), "add.jsonnet", Options{Prefix: "p", Strict: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Rename{
+		{"add.jsonnet", "add", "p_add", 1, 7, LocalBind},
+		{"add.jsonnet", "add", "p_add", 1, 26, VarUsage},
+	}
+	if !slices.Equal(renames, want) {
+		t.Errorf("renames %v, want %v", renames, want)
+	}
+}
+
+// Names reused at every level of a function inside a comprehension inside an object, each
+// variable must be renamed only when the bind resolving it is prefixed, and evaluating the
+// bundle proves it still resolves to the same bind
+var nestedScopeTests = []struct {
+	name   string
+	source string
+	want   string
+}{
+	{
+		// the object local shadows the outer local in every field
+		name:   "object local over local",
+		source: "local x = 'outer';\n{ local x = 'object', a: x, b: [x] }\n",
+		want:   "local p_x = 'outer';\n{ local p_x = 'object', a: p_x, b: [p_x] }\n",
+	},
+	{
+		// the comprehension variable shadows the object local in the body but not in its own list
+		name:   "comprehension in object",
+		source: "{ local x = 'object', a: [x for x in [x + '!']] }\n",
+		want:   "{ local p_x = 'object', a: [x for x in [p_x + '!']] }\n",
+	},
+	{
+		// the parameter shadows the comprehension variable, which shadows the object local
+		name:   "function in comprehension in object",
+		source: "{ local x = 'object', a: [(function(x) x + '?')(x + v) + x for v in ['v'] for x in [v]] }\n",
+		want:   "{ local p_x = 'object', a: [(function(x) x + '?')(x + v) + x for v in ['v'] for x in [v]] }\n",
+	},
+	{
+		// a local in the function body shadows the parameter, a closure over the object
+		// local keeps referring to it
+		name:   "local in function in comprehension in object",
+		source: "{ local x = 'object', a: [(function(x) local x = 'inner'; [x, y])(y) for y in [x]] }\n",
+		want:   "{ local p_x = 'object', a: [(function(x) local p_x = 'inner'; [p_x, y])(y) for y in [p_x]] }\n",
+	},
+	{
+		// an object comprehension key and value see the variable, the function body sees
+		// both its parameter and the variable
+		name:   "object comprehension with function",
+		source: "local y = 'outer';\n{ local x = 'object', a: { [x]: (function(y) x + y)('-') + y for x in [x] } }\n",
+		want:   "local p_y = 'outer';\n{ local p_x = 'object', a: { [x]: (function(y) x + y)('-') + p_y for x in [p_x] } }\n",
+	},
+	{
+		name: "every level",
+		source: `local x = 'outer';
+{
+  local x = 'object',
+  a: [x for x in ['comp']],
+  b: [(function(x) x)(v) + x for v in ['fn']],
+  c: [local x = v + '!'; x for v in [x]],
+  d: { [x]: (function(y) x + y)('-') for x in ['k'] },
+  e: [(function(v, w=v + x) w)(x) for x in ['default']],
+  f: [
+    (function(f) [f + g for g in [f]])(x)
+    for x in [x + '.comp']
+    for f in [x]
+  ],
+  g: local h = function(x) { local x2 = x, [x]: [x2 + z for z in [x]] }; h(x),
+}
+`,
+		want: `local p_x = 'outer';
+{
+  local p_x = 'object',
+  a: [x for x in ['comp']],
+  b: [(function(x) x)(v) + p_x for v in ['fn']],
+  c: [local p_x = v + '!'; p_x for v in [p_x]],
+  d: { [x]: (function(y) x + y)('-') for x in ['k'] },
+  e: [(function(v, w=v + x) w)(x) for x in ['default']],
+  f: [
+    (function(f) [f + g for g in [f]])(x)
+    for x in [p_x + '.comp']
+    for f in [x]
+  ],
+  g: local p_h = function(x) { local p_x2 = x, [x]: [p_x2 + z for z in [x]] }; p_h(p_x),
+}
+`,
+	},
+}
+
+func TestNestedScopes(t *testing.T) {
+	for _, tt := range nestedScopeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := roundTrip(t, "scopes.jsonnet", tt.source, Options{Prefix: "p", Strict: true})
+			if got != tt.want {
+				t.Errorf("bundle:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+// A local bound to an import is prefixed like any other, and with inlining its usages
+// reach the inlined file through it
+func TestLocalBoundToImport(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.jsonnet":  "local lib = import 'lib.libsonnet';\nlib.foo\n",
+		"lib.libsonnet": "local foo = 'bar';\n{ foo: foo }\n",
+	})
+	main := filepath.Join(dir, "main.jsonnet")
+
+	tests := []struct {
+		inline bool
+		want   string
+	}{
+		{false, "local p_lib = import 'lib.libsonnet';\np_lib.foo\n"},
+		{true, "local lib = (\nlocal lib_foo = 'bar';\n{ foo: lib_foo }\n);\nlocal p_lib = lib;\np_lib.foo\n"},
+	}
+
+	for _, tt := range tests {
+		opts := Options{Prefix: "p", PrefixStyle: PrefixStylePath, HashRoot: dir, InlineImports: tt.inline, Strict: true}
+		got := roundTrip(t, main, string(mustRead(t, main)), opts)
+		if got != tt.want {
+			t.Errorf("inline %t: bundle:\n%s\nwant:\n%s", tt.inline, got, tt.want)
+		}
+	}
+}
+
+// Inlining a pair of files importing each other fails naming the cycle instead of recursing
+func TestImportCycle(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.libsonnet": "local b = import 'b.libsonnet';\n{ a: 1, b: b.b }\n",
+		"b.libsonnet": "local a = import 'a.libsonnet';\n{ b: 2, a: a.a }\n",
+	})
+	a, b := filepath.Join(dir, "a.libsonnet"), filepath.Join(dir, "b.libsonnet")
+
+	_, err := BundleFiles([]string{a}, Options{InlineImports: true})
+	if err == nil {
+		t.Fatal("bundling an import cycle succeeded")
+	}
+	if want := "import cycle: " + a + " -> " + b + " -> " + a; !strings.Contains(err.Error(), want) {
+		t.Errorf("error %q doesn't name the cycle %q", err, want)
+	}
+}
+
+// A file imported along both sides of a diamond is inlined once, every import of it
+// referring to the same local
+func TestDiamondImport(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.jsonnet":    "local left = import 'left.libsonnet', right = import 'right.libsonnet';\n[left.v, right.v, (import 'util.libsonnet').v]\n",
+		"left.libsonnet":  "local util = import 'util.libsonnet';\n{ v: 'left ' + util.v }\n",
+		"right.libsonnet": "local util = import 'util.libsonnet';\n{ v: 'right ' + util.v }\n",
+		"util.libsonnet":  "{ v: 'util' }\n",
+	})
+	main := filepath.Join(dir, "main.jsonnet")
+
+	got := roundTrip(t, main, string(mustRead(t, main)), Options{PrefixStyle: PrefixStylePath, HashRoot: dir, InlineImports: true, Strict: true})
+
+	if n := strings.Count(got, "local util = ("); n != 1 {
+		t.Errorf("util.libsonnet inlined %d times, want once:\n%s", n, got)
+	}
+	if strings.Contains(got, "import") {
+		t.Errorf("bundle still imports:\n%s", got)
+	}
+}
+
+// Hasher giving every file the same prefix
+type constHasher struct{}
+
+func (constHasher) Hash(string) string { return "_same" }
+
+// Two files getting the same prefix fail the bundle with a hash algorithm, and are told
+// apart with a suffix when the prefixes are names from Options.HashFunc
+func TestPrefixBindClash(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.libsonnet":   "local b = import 'a/b.libsonnet';\n{ x: b.x }\n",
+		"a/b.libsonnet": "local x = 1;\n{ x: x }\n",
+		"want.jsonnet":  "{ 'a/b.libsonnet': import 'a/b.libsonnet', 'a.libsonnet': import 'a.libsonnet' }\n",
+	})
+	a, b := filepath.Join(dir, "a.libsonnet"), filepath.Join(dir, "a", "b.libsonnet")
+
+	// the bind `b` of a.libsonnet and a/b.libsonnet would both be a_b, whether the
+	// prefix of a/b.libsonnet is claimed when it's inlined or up front as an input
+	roundTrip(t, a, string(mustRead(t, a)), Options{PrefixStyle: PrefixStylePath, HashRoot: dir, InlineImports: true, Strict: true})
+
+	wantFile := filepath.Join(dir, "want.jsonnet")
+	want := evalJSON(t, wantFile, mustRead(t, wantFile))
+
+	out, err := BundleFiles([]string{b, a}, Options{Strategy: StrategyObject, PrefixStyle: PrefixStylePath, HashRoot: dir, HeaderRoot: dir, InlineImports: true, Strict: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := evalJSON(t, wantFile, out); got != want {
+		t.Errorf("bundle evaluates to %s, want %s\n%s", got, want, out)
+	}
+}
+
+func TestPrefixCollision(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.libsonnet": "local v = 'a';\nv\n",
+		"b.libsonnet": "local v = 'b';\nv\n",
+	})
+	a, b := filepath.Join(dir, "a.libsonnet"), filepath.Join(dir, "b.libsonnet")
+
+	hashers["const"] = constHasher{}
+	defer delete(hashers, "const")
+
+	_, err := BundleFiles([]string{a, b}, Options{Hash: "const"})
+	if want := "prefix collision: " + a + " and " + b + " both use prefix _same"; err == nil || err.Error() != want {
+		t.Errorf("error %v, want %q", err, want)
+	}
+
+	out, err := BundleFiles([]string{a, b}, Options{HashFunc: func(string) string { return "same" }, Strict: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"local same_v = 'a';", "local same_2_v = 'b';"} {
+		if !strings.Contains(string(out), name) {
+			t.Errorf("bundle doesn't contain %q:\n%s", name, out)
+		}
+	}
+}
+
+// A file with CRLF line endings is renamed at the same lines and columns as its LF twin,
+// keeping its line endings
+func TestCRLF(t *testing.T) {
+	lf := "local a = 1,\n  b = a + 1;\n{\n  local c = b,\n  v: [a, b, c],\n}\n"
+	crlf := strings.ReplaceAll(lf, "\n", "\r\n")
+
+	opts := Options{Prefix: "p", Strict: true}
+	gotLF, renamesLF, err := BundleReport([]byte(lf), "lf.jsonnet", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotCRLF, renamesCRLF, err := BundleReport([]byte(crlf), "lf.jsonnet", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := strings.ReplaceAll(string(gotLF), "\n", "\r\n"); string(gotCRLF) != want {
+		t.Errorf("CRLF bundle %q, want %q", gotCRLF, want)
+	}
+	if !slices.Equal(renamesCRLF, renamesLF) {
+		t.Errorf("CRLF renames %v, want %v", renamesCRLF, renamesLF)
+	}
+	roundTrip(t, "crlf.jsonnet", crlf, opts)
+}
+
+// Adjacent replacements growing the text each land at their own span, without writing
+// into the source even when its backing array has room to spare
+func TestApplyAdjacentReplacements(t *testing.T) {
+	source := make([]byte, 0, 64)
+	source = append(source, "ab+cd;"...)
+
+	ctx := mustContext(t, source, "adjacent.jsonnet", Options{})
+	ctx.Replacements = []Replacement{
+		{3, 5, "longer_cd", "cd", VarUsage},
+		{0, 2, "longer_ab", "ab", VarUsage},
+		{2, 3, " + ", "+", VarUsage},
+	}
+
+	got, err := ApplyReplacements(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "longer_ab + longer_cd;"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if spare := source[len(source):cap(source)]; string(source) != "ab+cd;" || strings.Trim(string(spare), "\x00") != "" {
+		t.Errorf("source changed to %q, followed by %q", source, spare)
+	}
+}
+
+// Overlapping replacements are reported instead of corrupting the output
+func TestApplyOverlappingReplacements(t *testing.T) {
+	ctx := mustContext(t, []byte("local abc = 1;\nabc"), "overlap.jsonnet", Options{})
+	ctx.Replacements = []Replacement{
+		{6, 9, "p_abc", "abc", LocalBind},
+		{7, 10, "x", "bc ", VarUsage},
+	}
+
+	_, err := ApplyReplacements(ctx)
+	want := `overlap.jsonnet: overlapping replacements "p_abc" at 1:7-1:10 and "x" at 1:8-1:11`
+	if err == nil || err.Error() != want {
+		t.Errorf("error %v, want %q", err, want)
+	}
+}
+
+// A shebang stays the first line, above the header, followed by the first n comment lines
+func TestShebang(t *testing.T) {
+	source := "#!/usr/bin/env jsonnet\n// license\n// more license\n// about x\nlocal x = 1;\nx\n"
+
+	tests := []struct {
+		preserve int
+		want     string
+	}{
+		{0, "#!/usr/bin/env jsonnet\n// header\n// license\n// more license\n// about x\nlocal p_x = 1;\np_x\n"},
+		{2, "#!/usr/bin/env jsonnet\n// license\n// more license\n// header\n// about x\nlocal p_x = 1;\np_x\n"},
+		{5, "#!/usr/bin/env jsonnet\n// license\n// more license\n// about x\n// header\nlocal p_x = 1;\np_x\n"},
+	}
+
+	for _, tt := range tests {
+		opts := Options{Prefix: "p", Header: true, HeaderTemplate: "// header", PreserveLeading: tt.preserve, Strict: true}
+		got := roundTrip(t, "shebang.jsonnet", source, opts)
+		if got != tt.want {
+			t.Errorf("preserve %d: bundle:\n%s\nwant:\n%s", tt.preserve, got, tt.want)
+		}
+	}
+}
+
+// The object strategy evaluates to an object of what each file evaluates to, `$` in a file
+// or in a file inlined into it still referring to the file's own outermost object
+func TestObjectStrategy(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.libsonnet":     "local one = 1;\n{ a: one, b: $.a }\n",
+		"b.libsonnet":     "local c = import 'lib/c.libsonnet';\n{ d: c.e, f: $.d }\n",
+		"lib/c.libsonnet": "{ x: 2, e: $.x }\n",
+		"empty.libsonnet": "// nothing here\n",
+		"want.jsonnet":    "{ 'a.libsonnet': import 'a.libsonnet', 'b.libsonnet': import 'b.libsonnet', 'empty.libsonnet': null }\n",
+	})
+	inputs := []string{filepath.Join(dir, "b.libsonnet"), filepath.Join(dir, "empty.libsonnet"), filepath.Join(dir, "a.libsonnet")}
+	wantFile := filepath.Join(dir, "want.jsonnet")
+	want := evalJSON(t, wantFile, mustRead(t, wantFile))
+
+	for _, inline := range []bool{false, true} {
+		opts := Options{Strategy: StrategyObject, PrefixStyle: PrefixStylePath, HashRoot: dir, HeaderRoot: dir, InlineImports: inline, Strict: true}
+		out, err := BundleFiles(inputs, opts)
+		if err != nil {
+			t.Fatalf("inline %t: %v", inline, err)
+		}
+		if got := evalJSON(t, wantFile, out); got != want {
+			t.Errorf("inline %t: bundle evaluates to %s, want %s\n%s", inline, got, want, out)
+		}
+	}
+
+	out, err := BundleFiles(inputs[2:], Options{Strategy: StrategyObject, PrefixStyle: PrefixStylePath, HashRoot: dir, HeaderRoot: dir, Strict: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "local a = (\nlocal a_one = 1;\n{ a: a_one, b: $.a }\n);\n{\n  'a.libsonnet': a,\n}\n"; string(out) != want {
+		t.Errorf("bundle:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+// Inputs come after the inputs they import, unless they import each other in a cycle,
+// which is valid as long as the imports stay imports, the input order is kept then
+func TestSectionOrder(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.libsonnet":    "local b = import 'b.libsonnet';\n{ a: 1, b():: b.b }\n",
+		"b.libsonnet":    "local a = import 'a.libsonnet';\n{ b: 2, a():: a.a }\n",
+		"main.jsonnet":   "local util = import 'util.libsonnet';\nutil\n",
+		"util.libsonnet": "{}\n",
+	})
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	tests := []struct {
+		inputs []string
+		want   []string
+	}{
+		{[]string{"main.jsonnet", "util.libsonnet"}, []string{"util.libsonnet", "main.jsonnet"}},
+		{[]string{"b.libsonnet", "a.libsonnet"}, []string{"b.libsonnet", "a.libsonnet"}},
+		{[]string{"a.libsonnet", "b.libsonnet"}, []string{"a.libsonnet", "b.libsonnet"}},
+	}
+
+	for _, tt := range tests {
+		var inputs []string
+		for _, input := range tt.inputs {
+			inputs = append(inputs, path(input))
+		}
+
+		out, err := BundleFiles(inputs, Options{HeaderRoot: dir, Strict: true})
+		if err != nil {
+			t.Fatalf("%v: %v", tt.inputs, err)
+		}
+
+		var sections []string
+		for line := range strings.Lines(string(out)) {
+			if name, ok := strings.CutPrefix(line, "// "); ok {
+				sections = append(sections, strings.TrimSpace(name))
+			}
+		}
+		if !slices.Equal(sections, tt.want) {
+			t.Errorf("%v: sections %v, want %v", tt.inputs, sections, tt.want)
+		}
+	}
+
+	// the files of the cycle are still dependencies of the bundle for --watch and the manifest
+	_, deps, err := BundleFilesDeps([]string{path("a.libsonnet")}, Options{Strict: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{path("a.libsonnet"), path("b.libsonnet")}; !slices.Equal(deps, want) {
+		t.Errorf("dependencies %v, want %v", deps, want)
+	}
+}
+
+func TestCommentedLocals(t *testing.T) {
+	source := "// leading comment\nlocal a = 1;  // trailing comment\n/* block */ local b = /* inline */ a;\nlocal\n  // before c\n  c = b,  # hash comment\n  /* before d */ d = c;\n// before the body\n[a, b, c, d]\n"
+	want := "// leading comment\nlocal p_a = 1;  // trailing comment\n/* block */ local p_b = /* inline */ p_a;\nlocal\n  // before c\n  p_c = p_b,  # hash comment\n  /* before d */ p_d = p_c;\n// before the body\n[p_a, p_b, p_c, p_d]\n"
+
+	if got := roundTrip(t, "commented.jsonnet", source, Options{Prefix: "p", Strict: true}); got != want {
+		t.Errorf("bundle:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestEmptyInput(t *testing.T) {
+	for _, source := range []string{"", "// just a comment\n\n/* and a block */\n"} {
+		out, err := Bundle([]byte(source), "empty.jsonnet", Options{Prefix: "p", Strict: true})
+		if err != nil {
+			t.Fatalf("%q: %v", source, err)
+		}
+		if string(out) != source {
+			t.Errorf("%q: bundle %q, want the input as is", source, out)
+		}
+
+		out, err = Bundle([]byte(source), "empty.jsonnet", Options{Prefix: "p", Header: true, HeaderTemplate: "// header"})
+		if err != nil {
+			t.Fatalf("%q: %v", source, err)
+		}
+		if want := "// header\n" + source; string(out) != want {
+			t.Errorf("%q: bundle %q, want %q", source, out, want)
+		}
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.jsonnet":  "local lib = import 'lib.libsonnet';\nlocal data = import 'data';\nlocal other = import 'other.jsonnet';\n{ lib: lib.v, data: data.v, other: other }\n",
+		"lib.libsonnet": "local v = 'lib';\n{ v: v }\n",
+		"data":          "local v = 'data';\n{ v: v }\n",
+		"other.jsonnet": "local v = 'other';\nv\n",
+	})
+	main := filepath.Join(dir, "main.jsonnet")
+
+	want := evalJSON(t, main, mustRead(t, main))
+
+	for _, inline := range []bool{false, true} {
+		out, err := BundleFiles([]string{main}, Options{PrefixStyle: PrefixStylePath, HashRoot: dir, InlineImports: inline, Strict: true})
+		if err != nil {
+			t.Fatalf("inline %t: %v", inline, err)
+		}
+		if got := evalJSON(t, main, out); got != want {
+			t.Errorf("inline %t: bundle evaluates to %s, want %s\n%s", inline, got, want, out)
+		}
+		if inline && strings.Contains(string(out), "import") {
+			t.Errorf("inline %t: bundle still imports:\n%s", inline, out)
+		}
+	}
+}
+
+// Importer finding files like the wrapped one but returning other contents, as if every
+// file had changed on disk since the bundle read it
+type changedImporter struct{ jsonnet.Importer }
+
+func (i changedImporter) Import(importedFrom, importedPath string) (jsonnet.Contents, string, error) {
+	_, foundAt, err := i.Importer.Import(importedFrom, importedPath)
+	return jsonnet.MakeContents("{ v: 'changed' }\n"), foundAt, err
+}
+
+func TestInputsReadOnce(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"lib.libsonnet": "local v = 'lib';\n{ v: v }\n",
+		"main.jsonnet":  "local lib = import 'lib.libsonnet';\n{ lib: lib.v }\n",
+	})
+	inputs := []string{filepath.Join(dir, "lib.libsonnet"), filepath.Join(dir, "main.jsonnet")}
+
+	opts := Options{PrefixStyle: PrefixStylePath, HashRoot: dir, InlineImports: true, Strict: true}
+	imports := newImportState(&opts)
+	imports.importer.Importer = changedImporter{imports.importer.Importer}
+
+	var contexts []*Context
+	for i, input := range inputs {
+		prefix, err := opts.filePrefix(input, i, len(inputs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		contexts = append(contexts, newContext(input, mustRead(t, input), prefix, &opts, imports))
+	}
+
+	// lib.libsonnet is inlined into main.jsonnet and evaluated for Strict from the bytes read for the input
+	out, err := bundle(contexts, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "changed") {
+		t.Errorf("bundle has contents read again from disk:\n%s", out)
+	}
+}
+
+func TestBindWithoutLocation(t *testing.T) {
+	ctx := mustContext(t, []byte("local f(x) = x;\nf(1)\n"), "sugar.jsonnet", Options{Prefix: "p"})
+	node, err := Parse(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// desugaring the function sugar drops the location of the bind, it's found from the function
+	bind := node.(*ast.Local).Binds[0]
+	if bind.LocRange.IsSet() {
+		t.Fatalf("bind of %q has location %v, want none after desugaring", bind.Variable, bind.LocRange)
+	}
+	rep, err := collectLocalBindReplacement(ctx, bind, "f", "p_f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.BeginOffset != 6 || rep.EndOffset != 7 {
+		t.Errorf("bind of %q at %d-%d, want 6-7", bind.Variable, rep.BeginOffset, rep.EndOffset)
+	}
+
+	// a synthesized bind with no location at all can't be renamed and is reported
+	bind = ast.LocalBind{Variable: "y", Body: &ast.LiteralNull{}}
+	if _, err := collectLocalBindReplacement(ctx, bind, "y", "p_y"); err == nil || err.Error() != "no location" {
+		t.Errorf("bind without location: error %v, want no location", err)
+	}
+}
+
+func TestKeepPragma(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"absent", "local a = 1;\na\n", "local p_a = 1;\np_a\n"},
+		{"slash comment", "// jb:keep\nlocal a = 1;\na\n", "// jb:keep\nlocal a = 1;\na\n"},
+		{"hash comment", "  #   jb:keep\nlocal a = 1, b = a;\nb\n", "  #   jb:keep\nlocal a = 1, b = a;\nb\n"},
+		{"line below only", "// jb:keep\nlocal a = 1;\nlocal b = a;\nb\n", "// jb:keep\nlocal a = 1;\nlocal p_b = a;\np_b\n"},
+		{"blank line between", "// jb:keep\n\nlocal a = 1;\na\n", "// jb:keep\n\nlocal p_a = 1;\np_a\n"},
+		{"other text", "// jb:keep a\nlocal a = 1;\na\n", "// jb:keep a\nlocal p_a = 1;\np_a\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := roundTrip(t, "keep.jsonnet", tt.source, Options{Prefix: "p", Strict: true}); got != tt.want {
+				t.Errorf("bundle:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFieldAccess(t *testing.T) {
+	source := "local x = 1;\nlocal o = { x: x, y: { x: 2 } };\n[x, o.x, o.y.x, o['x'], { x: 3 }.x, std.objectHas(o, 'x')]\n"
+	want := "local p_x = 1;\nlocal p_o = { x: p_x, y: { x: 2 } };\n[p_x, p_o.x, p_o.y.x, p_o['x'], { x: 3 }.x, std.objectHas(p_o, 'x')]\n"
+
+	if got := roundTrip(t, "fields.jsonnet", source, Options{Prefix: "p", Strict: true}); got != want {
+		t.Errorf("bundle:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestByteOrderMark(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.jsonnet":  "\xef\xbb\xbflocal lib = import 'lib.libsonnet';\nlocal x = 'é';\n[x, lib.v]\n",
+		"lib.libsonnet": "\xef\xbb\xbflocal v = 'lib';\n{ v: v }\n",
+	})
+	main := filepath.Join(dir, "main.jsonnet")
+
+	out, err := BundleFiles([]string{main}, Options{PrefixStyle: PrefixStylePath, HashRoot: dir, InlineImports: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "local lib = (\nlocal lib_v = 'lib';\n{ v: lib_v }\n);\nlocal main_lib = lib;\nlocal main_x = 'é';\n[main_x, main_lib.v]\n"
+	if string(out) != want {
+		t.Errorf("bundle:\n%s\nwant:\n%s", out, want)
+	}
+	if got := evalJSON(t, main, out); got != "[\n   \"é\",\n   \"lib\"\n]\n" {
+		t.Errorf("bundle evaluates to %s", got)
+	}
+}
+
+func TestPrefixSeparator(t *testing.T) {
+	source := "local a = 1;\nlocal f(x) = x + a;\n{ local b = f(a), c: b, d: [a for _ in [1]] }\n"
+	want := "local p__a = 1;\nlocal p__f(x) = x + p__a;\n{ local p__b = p__f(p__a), c: p__b, d: [p__a for _ in [1]] }\n"
+
+	if got := roundTrip(t, "sep.jsonnet", source, Options{Prefix: "p", PrefixSeparator: "__", Strict: true}); got != want {
+		t.Errorf("bundle:\n%s\nwant:\n%s", got, want)
+	}
+
+	if _, err := Bundle([]byte(source), "sep.jsonnet", Options{Prefix: "p", PrefixSeparator: "$"}); err == nil || !strings.Contains(err.Error(), "invalid prefix separator") {
+		t.Errorf("separator $: error %v, want an invalid separator", err)
+	}
+}
+
+func TestTrailingNewline(t *testing.T) {
+	tests := []struct {
+		source    string
+		normalize bool
+		want      string
+	}{
+		{"local a = 1;\na\n", false, "local p_a = 1;\np_a\n"},
+		{"local a = 1;\na", false, "local p_a = 1;\np_a"},
+		{"local a = 1;\na\n", true, "local p_a = 1;\np_a\n"},
+		{"local a = 1;\na", true, "local p_a = 1;\np_a\n"},
+		{"local a = 1;\na\n\n\r\n", true, "local p_a = 1;\np_a\n"},
+	}
+
+	for _, tt := range tests {
+		out, err := Bundle([]byte(tt.source), "newline.jsonnet", Options{Prefix: "p", NormalizeNewline: tt.normalize})
+		if err != nil {
+			t.Fatalf("%q: %v", tt.source, err)
+		}
+		if string(out) != tt.want {
+			t.Errorf("%q normalized %t: bundle %q, want %q", tt.source, tt.normalize, out, tt.want)
+		}
+	}
+}
+
+func TestRenameCollision(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		opts   Options
+		want   string
+	}{
+		{"excluded bind", "local x = 1, p_x = 2;\nx + p_x\n", Options{Prefix: "p", ExcludeNames: []string{"p_x"}},
+			`1:7: local bind "x" clashes after renaming: its new name "p_x" is the name of another bind of the same local that isn't prefixed`},
+		{"parameter", "local x = 1;\nlocal f(p_x) = x + p_x;\nf(2)\n", Options{Prefix: "p"},
+			`2:16: var "x" clashes after renaming: its new name "p_x" is bound around it by a bind that isn't prefixed`},
+		{"separator", "local x = 1;\nlocal f(p__x) = x + p__x;\nf(2)\n", Options{Prefix: "p", PrefixSeparator: "__"},
+			`2:17: var "x" clashes after renaming: its new name "p__x" is bound around it by a bind that isn't prefixed`},
+	}
+
+	for _, tt := range tests {
+		_, err := Bundle([]byte(tt.source), "collision.jsonnet", tt.opts)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestKeepAliases(t *testing.T) {
+	out, err := Bundle([]byte("local x = { a: 1 };\nlocal f(n) = n + 1;\nnull\n"), "alias.jsonnet", Options{Prefix: "p", KeepAliases: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the original names are still in scope where the body was and refer to the same values
+	body, ok := strings.CutSuffix(string(out), "null\n")
+	if !ok {
+		t.Fatalf("bundle doesn't end with the body:\n%s", out)
+	}
+	got := evalJSON(t, "alias.jsonnet", []byte(body+"[x == p_x, f(1) == p_f(1), x, f(1)]\n"))
+	if want := "[\n   true,\n   true,\n   {\n      \"a\": 1\n   },\n   2\n]\n"; got != want {
+		t.Errorf("aliases evaluate to %s, want %s\n%s", got, want, out)
+	}
+
+	// each file aliases its own locals, the aliases of one don't leak into another inlined into it
+	dir := writeFiles(t, map[string]string{
+		"main.jsonnet":  "local x = 'main';\nlocal lib = import 'lib.libsonnet';\n[x, lib.x]\n",
+		"lib.libsonnet": "local x = 'lib';\n{ x: x }\n",
+	})
+	main := filepath.Join(dir, "main.jsonnet")
+	roundTrip(t, main, string(mustRead(t, main)), Options{PrefixStyle: PrefixStylePath, HashRoot: dir, InlineImports: true, KeepAliases: true, Strict: true})
+}
+
+func TestUnusedLocals(t *testing.T) {
+	source := "local used = 1, unused = 2;\nlocal f(x) = used;\n{ local dead = 3, v: f(0) }\n"
+
+	ctx := mustContext(t, []byte(source), "unused.jsonnet", Options{Prefix: "p", WarnUnused: true})
+	if err := Collect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// parameters such as x aren't prefixed so they're never reported
+	want := []Rename{
+		{"unused.jsonnet", "unused", "p_unused", 1, 17, LocalBind},
+		{"unused.jsonnet", "dead", "p_dead", 3, 9, LocalBind},
+	}
+	if !slices.Equal(ctx.Unused, want) {
+		t.Errorf("unused %v, want %v", ctx.Unused, want)
+	}
+}
+
+// The manifest hashes the files as read, including a byte order mark dropped for bundling
+func TestManifestHashesFilesAsRead(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.jsonnet":  "\uFEFFlocal lib = import 'lib.libsonnet';\n{ a: lib.a }\n",
+		"lib.libsonnet": "\uFEFF{ a: 1 }\n",
+	})
+
+	var manifest Manifest
+	if _, err := BundleFiles([]string{filepath.Join(dir, "main.jsonnet")}, Options{InlineImports: true, Manifest: &manifest}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(manifest.Files) != 2 {
+		t.Fatalf("got %d files in the manifest, want 2", len(manifest.Files))
+	}
+	for _, file := range manifest.Files {
+		sum := sha256.Sum256(mustRead(t, file.Path))
+		if want := hex.EncodeToString(sum[:]); file.SHA256 != want {
+			t.Errorf("got sha256 %s for %s, want %s", file.SHA256, file.Path, want)
+		}
+	}
+}
+
+// Generate a source with n locals each used m times
+func genLocals(n, m int) []byte {
+	var b strings.Builder
+	for i := range n {
+		fmt.Fprintf(&b, "local v%d = %d;\n", i, i)
+	}
+	b.WriteString("[\n")
+	for i := range n {
+		for range m {
+			fmt.Fprintf(&b, "  v%d,\n", i)
+		}
+	}
+	b.WriteString("]\n")
+
+	return []byte(b.String())
+}
+
+// Sizes of the generated sources of the collection and apply benchmarks, locals by usages
+var benchSizes = []struct{ locals, usages int }{
+	{10, 1},
+	{100, 10},
+	{1000, 10},
+}
+
+func BenchmarkCollect(b *testing.B) {
+	for _, size := range benchSizes {
+		source := genLocals(size.locals, size.usages)
+		b.Run(fmt.Sprintf("%dx%d", size.locals, size.usages), func(b *testing.B) {
+			b.SetBytes(int64(len(source)))
+			for b.Loop() {
+				if err := Collect(mustContext(b, source, "bench.jsonnet", Options{Prefix: "p"})); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkApply(b *testing.B) {
+	for _, size := range benchSizes {
+		ctx := mustContext(b, genLocals(size.locals, size.usages), "bench.jsonnet", Options{Prefix: "p"})
+		if err := Collect(ctx); err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fmt.Sprintf("%dx%d", size.locals, size.usages), func(b *testing.B) {
+			b.SetBytes(int64(len(ctx.Source)))
+			for b.Loop() {
+				if _, err := ApplyReplacements(ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Apply the replacements of a file with 10k locals, bound by a single local so the
+// collection the benchmark starts from doesn't resolve each usage through 10k scopes
+func BenchmarkApplyManyLocals(b *testing.B) {
+	var source strings.Builder
+	source.WriteString("local v0 = 0")
+	for i := 1; i < 10000; i++ {
+		fmt.Fprintf(&source, ",\n  v%d = %d", i, i)
+	}
+	source.WriteString(";\n[\n")
+	for i := range 10000 {
+		fmt.Fprintf(&source, "  v%d,\n", i)
+	}
+	source.WriteString("]\n")
+
+	ctx := mustContext(b, []byte(source.String()), "bench.jsonnet", Options{Prefix: "p"})
+	if err := Collect(ctx); err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(ctx.Source)))
+	for b.Loop() {
+		if _, err := ApplyReplacements(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Bundle 500 files collected one at a time and by a worker for each CPU
+func BenchmarkCollectInputs(b *testing.B) {
+	files := make(map[string]string)
+	var inputs []string
+	for i := range 500 {
+		name := fmt.Sprintf("f%d.libsonnet", i)
+		files[name] = string(genLocals(20, 5))
+		inputs = append(inputs, name)
+	}
+	dir := writeFiles(b, files)
+	for i, input := range inputs {
+		inputs[i] = filepath.Join(dir, input)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		procs int
+	}{
+		{"serial", 1},
+		{"parallel", runtime.GOMAXPROCS(0)},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			if tt.name == "parallel" && tt.procs == 1 {
+				b.Skip("a single CPU collects the inputs serially")
+			}
+			defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(tt.procs))
+			for b.Loop() {
+				if _, err := BundleFiles(inputs, Options{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Index the lines of a 50MB generated file
+func BenchmarkBuildLineOffsets(b *testing.B) {
+	line := []byte("  generated_field_name: 'a generated value',\n")
+	source := bytes.Repeat(line, 50<<20/len(line))
+
+	b.SetBytes(int64(len(source)))
+	b.ReportAllocs()
+	for b.Loop() {
+		buildLineOffsets(source)
+	}
+}
@@ -0,0 +1,152 @@
+package bundler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Version of the cached data, bump whenever what the collection passes produce changes
+// so entries written by older versions are never reused
+const cacheVersion = "5"
+
+// Cache of the collection results of files keyed by their content and prefix, so unchanged
+// files aren't parsed again on rebuilds. Safe for concurrent use, a nil cache caches nothing
+type Cache struct {
+	// directory entries are persisted to across runs, memory only when empty
+	dir string
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+// Everything needed to bundle a file again without parsing it
+type cacheEntry struct {
+	// replacements collected by the local bind and variable passes
+	Replacements []Replacement
+	// renames that couldn't be applied
+	Failures []RenameError
+	// prefixed local binds no variable refers to
+	Unused []Rename
+	// imports found for the third pass
+	Imports []importSite
+}
+
+// Create a cache kept in memory and, when dir isn't empty, persisted to dir
+func NewCache(dir string) *Cache {
+	return &Cache{dir: dir, entries: make(map[string]*cacheEntry)}
+}
+
+// Get the cache key of the file of the context, the collection passes only depend on
+// the source, the prefix, the options choosing which binds are renamed and the prefixes
+// of other files that binds must not be renamed to
+func cacheKey(ctx *Context) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%t\x00%t\x00%t\x00%s\x00%s\x00", cacheVersion, ctx.Prefix, ctx.opts.prefixSeparator(), ctx.opts.Strategy,
+		ctx.opts.OnlyExported, ctx.opts.StripLeadingComments, ctx.opts.KeepAliases, strings.Join(ctx.opts.ExcludeNames, ","),
+		strings.Join(ctx.imports.prefixesUnder(ctx.Prefix+ctx.opts.prefixSeparator()), ","))
+	h.Write(ctx.Source)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func newCacheEntry(ctx *Context, sites []importSite) *cacheEntry {
+	entry := &cacheEntry{Replacements: slices.Clone(ctx.Replacements), Unused: slices.Clone(ctx.Unused), Imports: sites}
+	for _, err := range ctx.Failures {
+		if rerr, ok := err.(*RenameError); ok {
+			entry.Failures = append(entry.Failures, *rerr)
+		}
+	}
+
+	return entry
+}
+
+// Set the results of the collection passes on the context from the entry
+func (e *cacheEntry) restore(ctx *Context) {
+	ctx.Replacements = slices.Clone(e.Replacements)
+	ctx.Unused = slices.Clone(e.Unused)
+	for _, rerr := range e.Failures {
+		ctx.Failures = append(ctx.Failures, &rerr)
+	}
+}
+
+// Get the entry for the key from memory or from the cache directory
+func (c *Cache) get(key string) (*cacheEntry, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.entries[key]; ok {
+		return entry, true
+	}
+
+	if c.dir == "" {
+		return nil, false
+	}
+
+	data, err := os.ReadFile(filepath.Join(c.dir, key))
+	if err != nil {
+		return nil, false
+	}
+
+	// an entry that can't be decoded is treated as missing and overwritten
+	entry := &cacheEntry{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(entry); err != nil {
+		return nil, false
+	}
+	c.entries[key] = entry
+
+	return entry, true
+}
+
+// Store the entry for the key in memory and in the cache directory
+func (c *Cache) put(key string, entry *cacheEntry) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = entry
+
+	if c.dir == "" {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(c.dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a concurrent run never reads a partial entry
+	tmp, err := os.CreateTemp(c.dir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(c.dir, key))
+}
@@ -0,0 +1,56 @@
+package bundler
+
+// Version of the edits format
+const editsVersion = 1
+
+// Edits lists every replacement made by bundling, for editor tooling showing what the
+// bundle changes in each file
+type Edits struct {
+	Version int `json:"version"`
+	// the edits of each file in the order the files were applied, each file's in source order
+	Edits []Edit `json:"edits"`
+}
+
+// A replacement made in a file of the bundle, an input or a file inlined into it
+type Edit struct {
+	// name of the file the replacement was applied to
+	File string `json:"file"`
+	// what the replacement is for, see the Kind constants
+	Kind Kind `json:"kind"`
+	// the span replaced as found in the source
+	Old string `json:"old"`
+	// the text replacing it
+	New string `json:"new"`
+	// 1-based location of the span in the original source, the end is just after it
+	Line      int `json:"line"`
+	Column    int `json:"column"`
+	EndLine   int `json:"endLine"`
+	EndColumn int `json:"endColumn"`
+	// byte offsets of the span in the original source
+	BeginOffset int `json:"beginOffset"`
+	EndOffset   int `json:"endOffset"`
+}
+
+// Get the edits of the replacements of the context, in source order
+func edits(ctx *Context) []Edit {
+	reps := sortedReplacements(ctx)
+
+	out := make([]Edit, 0, len(reps))
+	for _, rep := range reps {
+		begin, end := ctx.location(rep.BeginOffset), ctx.location(rep.EndOffset)
+		out = append(out, Edit{
+			File:        ctx.Filename,
+			Kind:        rep.Kind,
+			Old:         string(ctx.Source[rep.BeginOffset:rep.EndOffset]),
+			New:         rep.NewValue,
+			Line:        begin.Line,
+			Column:      begin.Column,
+			EndLine:     end.Line,
+			EndColumn:   end.Column,
+			BeginOffset: rep.BeginOffset,
+			EndOffset:   rep.EndOffset,
+		})
+	}
+
+	return out
+}
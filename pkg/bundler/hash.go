@@ -0,0 +1,145 @@
+package bundler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/nr8-io/jsonnet-bundler/pkg/parser"
+)
+
+// A hasher derives a prefix from a file name, the result must be a valid identifier
+type hasher interface {
+	Hash(filename string) string
+}
+
+// FNV-1a 32-bit, short prefixes for bundles of a moderate number of files
+type fnvHasher struct{}
+
+func (fnvHasher) Hash(filename string) string {
+	h := fnv.New32a()
+	h.Write([]byte(filename))
+	// add underscore to ensure valid identifier
+	return fmt.Sprintf("_%08x", h.Sum32())
+}
+
+// SHA-256 truncated to 12 hex characters, lower collision probability for large bundles
+type sha256Hasher struct{}
+
+func (sha256Hasher) Hash(filename string) string {
+	sum := sha256.Sum256([]byte(filename))
+	// add underscore to ensure valid identifier
+	return "_" + hex.EncodeToString(sum[:])[:12]
+}
+
+// Hash algorithms selectable with Options.Hash and the --hash flag
+var hashers = map[string]hasher{
+	"fnv":    fnvHasher{},
+	"sha256": sha256Hasher{},
+}
+
+// Jsonnet keywords, which aren't valid identifiers, and std, which a prefix must not shadow
+var keywords = []string{
+	"assert", "else", "error", "false", "for", "function", "if", "import", "importstr",
+	"importbin", "in", "local", "null", "tailstrict", "then", "self", "super", "true", "std",
+}
+
+// Readable prefix made of the file path without its extension, e.g. `lib_konn_main`
+// for `lib/konn/main.libsonnet`, see PrefixStylePath
+func pathPrefix(path string) string {
+	return normalizePrefix(strings.TrimSuffix(path, filepath.Ext(path)))
+}
+
+// Make a valid Jsonnet identifier out of a prefix, replacing the characters that can't
+// be part of one such as dots and dashes with underscores, and prepending an underscore
+// when it would be empty, start with a digit or be a keyword
+func normalizePrefix(prefix string) string {
+	b := []byte(prefix)
+	for i := range b {
+		if !isIdentifierByteAt(b, i) {
+			b[i] = '_'
+		}
+	}
+
+	if len(b) == 0 || '0' <= b[0] && b[0] <= '9' || slices.Contains(keywords, string(b)) {
+		b = append([]byte{'_'}, b...)
+	}
+
+	return string(b)
+}
+
+// Get the names of the available hash algorithms in sorted order
+func HasherNames() []string {
+	var names []string
+	for name := range hashers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+// Generate a prefix from the filename using HashFunc, the path with PrefixStylePath or
+// the Hash algorithm, failing when HashFunc doesn't return a valid identifier
+func (o *Options) hash(filename string) (string, error) {
+	if o.HashFunc != nil {
+		prefix := o.HashFunc(o.hashPath(filename))
+		if !parser.IsValidIdentifier(prefix) {
+			return "", fmt.Errorf("invalid prefix %q for %s: HashFunc must return a valid Jsonnet identifier", prefix, filename)
+		}
+
+		return prefix, nil
+	}
+
+	if o.PrefixStyle == PrefixStylePath {
+		return pathPrefix(o.hashPath(filename)), nil
+	}
+
+	name := o.Hash
+	if name == "" {
+		name = "fnv"
+	}
+
+	return hashers[name].Hash(o.hashPath(filename)), nil
+}
+
+// Check whether prefixes are readable names derived from the file paths, which collide
+// for paths only differing in characters replaced with underscores such as `a-b` and `a_b`
+func (o *Options) namedPrefixes() bool {
+	return o.HashFunc != nil || o.PrefixStyle == PrefixStylePath
+}
+
+// Get the path that is hashed for the file, relative to HashRoot when set so
+// the prefix doesn't depend on the working directory or how the file was referenced,
+// and relative to the working directory otherwise with PrefixStylePath
+func (o *Options) hashPath(filename string) string {
+	root := o.HashRoot
+	if root == "" && o.PrefixStyle == PrefixStylePath {
+		root = "."
+	}
+	if root == "" || filename == stdinName {
+		return filename
+	}
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return filename
+	}
+
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return filename
+	}
+
+	rel, err := filepath.Rel(root, abs)
+	if err != nil {
+		return filename
+	}
+
+	// use forward slashes so prefixes are the same on every platform
+	return filepath.ToSlash(rel)
+}
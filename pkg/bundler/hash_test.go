@@ -0,0 +1,93 @@
+package bundler
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNormalizePrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"lib", "lib"},
+		{"1.2.3-rc", "_1_2_3_rc"},
+		{"my-lib.v2", "my_lib_v2"},
+		{"9foo", "_9foo"},
+		{"local", "_local"},
+		{"std", "_std"},
+		{"", "_"},
+	}
+
+	for _, tt := range tests {
+		if got := normalizePrefix(tt.prefix); got != tt.want {
+			t.Errorf("normalizePrefix(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestPrefixFromFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{"path", Options{PrefixStyle: PrefixStylePath}, "_1_2_3_rc"},
+		{"HashFunc", Options{HashFunc: func(filename string) string { return "_" + strings.NewReplacer(".", "_", "-", "_").Replace(filename) }}, "_1_2_3_rc_libsonnet"},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.opts.hash("1.2.3-rc.libsonnet")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: prefix of 1.2.3-rc.libsonnet %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// A HashFunc result that isn't a valid identifier is reported rather than rewritten
+func TestPrefixFromHashFuncInvalid(t *testing.T) {
+	for _, prefix := range []string{"1.2.3-rc", "my-lib", "local", ""} {
+		opts := Options{HashFunc: func(string) string { return prefix }}
+		_, err := opts.hash("lib.libsonnet")
+		if err == nil {
+			t.Errorf("prefix %q: no error", prefix)
+			continue
+		}
+		if want := fmt.Sprintf("invalid prefix %q for lib.libsonnet", prefix); !strings.Contains(err.Error(), want) {
+			t.Errorf("prefix %q: error %q doesn't contain %q", prefix, err, want)
+		}
+	}
+}
+
+// Path prefixes are relative to the working directory or HashRoot, with an underscore
+// only prepended when the name would start with a digit, be a keyword or shadow std
+func TestPathPrefix(t *testing.T) {
+	root := t.TempDir()
+
+	tests := []struct {
+		filename string
+		opts     Options
+		want     string
+	}{
+		{"lib/konn/main.libsonnet", Options{PrefixStyle: PrefixStylePath}, "lib_konn_main"},
+		{filepath.Join(root, "lib", "konn", "main.libsonnet"), Options{PrefixStyle: PrefixStylePath, HashRoot: root}, "lib_konn_main"},
+		{"1.2.3-rc.libsonnet", Options{PrefixStyle: PrefixStylePath}, "_1_2_3_rc"},
+		{"local.libsonnet", Options{PrefixStyle: PrefixStylePath}, "_local"},
+		{"std.libsonnet", Options{PrefixStyle: PrefixStylePath}, "_std"},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.opts.hash(tt.filename)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.filename, err)
+		}
+		if got != tt.want {
+			t.Errorf("prefix of %s %q, want %q", tt.filename, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,547 @@
+package bundler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/google/go-jsonnet"
+	"github.com/google/go-jsonnet/ast"
+	"github.com/nr8-io/jsonnet-bundler/pkg/parser"
+)
+
+// Import state shared by the contexts of all files in a bundle
+type importState struct {
+	// importer used to resolve imports
+	importer *sourceImporter
+	// VMs parsing and evaluating the files, shared by the workers collecting the inputs
+	vms *vmPool
+	// files already inlined by canonical path
+	inlined map[string]*inlinedFile
+	// files imported by each file by canonical path, used to order the bundled sections
+	deps map[string][]string
+	// name each canonical path was first referenced by, used in messages
+	names map[string]string
+	// canonical path of the file each prefix was assigned to
+	prefixes map[string]string
+	// prefixed names of the binds of the files collected so far, see claimPrefix
+	binds map[string]bool
+	// SHA-256 of the inputs as read, before a byte order mark was dropped, for the manifest
+	sums map[string][sha256.Size]byte
+	// renames applied to every file of the bundle, in the order the files were applied
+	renames []Rename
+	// replacements made in every file of the bundle, in the same order
+	edits []Edit
+}
+
+// A file inlined into the bundle, emitted once as a local bound to its prefix
+type inlinedFile struct {
+	// prefix of the file, also the name its bundled source is bound to
+	prefix string
+	// the bundled source of the file
+	source []byte
+	// mappings of the bundled source back to the file
+	mappings []mapping
+}
+
+func newImportState(opts *Options) *importState {
+	return &importState{
+		importer: &sourceImporter{Importer: opts.importer(), sources: make(map[string]jsonnet.Contents)},
+		vms:      newVMPool(opts),
+		inlined:  make(map[string]*inlinedFile),
+		deps:     make(map[string][]string),
+		names:    make(map[string]string),
+		prefixes: make(map[string]string),
+		binds:    make(map[string]bool),
+		sums:     make(map[string][sha256.Size]byte),
+	}
+}
+
+// Importer resolving imports with the wrapped importer but serving the files already read
+// into the bundle, the inputs and every file imported before, from their bytes in memory.
+// Every copy of a file in the bundle then comes from the same bytes even if the file changes
+// on disk while bundling
+type sourceImporter struct {
+	jsonnet.Importer
+	// sources of the files already read by canonical path
+	sources map[string]jsonnet.Contents
+}
+
+// Serve the source of the file from memory when it's imported
+func (i *sourceImporter) add(path string, source []byte) {
+	i.sources[canonicalPath(path)] = jsonnet.MakeContents(string(source))
+}
+
+func (i *sourceImporter) Import(importedFrom, importedPath string) (jsonnet.Contents, string, error) {
+	// the file evaluated by the VM is imported from nowhere, it may not exist on disk like stdin
+	if source, ok := i.sources[canonicalPath(importedPath)]; ok && importedFrom == "" {
+		return source, importedPath, nil
+	}
+
+	contents, foundAt, err := i.Importer.Import(importedFrom, importedPath)
+	if err != nil {
+		return contents, foundAt, err
+	}
+
+	canon := canonicalPath(foundAt)
+	if source, ok := i.sources[canon]; ok {
+		return source, foundAt, nil
+	}
+	i.sources[canon] = contents
+
+	return contents, foundAt, nil
+}
+
+// Importer failing on imports that resolve outside of the root directories, see
+// Options.ImportRoots
+type rootedImporter struct {
+	jsonnet.Importer
+	// the resolved absolute paths of the roots
+	roots []string
+}
+
+func newRootedImporter(importer jsonnet.Importer, roots []string) *rootedImporter {
+	rooted := &rootedImporter{Importer: importer}
+	for _, root := range roots {
+		rooted.roots = append(rooted.roots, resolvePath(root))
+	}
+
+	return rooted
+}
+
+// Get the absolute path with symlinks resolved, so a link can't point out of a root
+func resolvePath(path string) string {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+
+	return canonicalPath(path)
+}
+
+func (i *rootedImporter) Import(importedFrom, importedPath string) (jsonnet.Contents, string, error) {
+	contents, foundAt, err := i.Importer.Import(importedFrom, importedPath)
+	if err != nil {
+		return contents, foundAt, err
+	}
+
+	path := resolvePath(foundAt)
+	for _, root := range i.roots {
+		if rel, err := filepath.Rel(root, path); err == nil && filepath.IsLocal(rel) {
+			return contents, foundAt, nil
+		}
+	}
+
+	return jsonnet.Contents{}, "", fmt.Errorf("import %q resolves to %s outside of the import roots", importedPath, path)
+}
+
+// Assign the prefix to the file, returning the prefix to use. A prefix already assigned
+// to a different file would merge the namespaces of both files, and one that is the
+// prefixed name of a bind already collected would shadow the local the file is inlined as,
+// e.g. `lib/util.libsonnet` and the bind `util` of `lib.libsonnet` with named prefixes.
+// Either fails unless disambiguate is set, then the file gets the first of prefix_2,
+// prefix_3 and so on that is free or already its own, so a file always gets the same one
+func (s *importState) claimPrefix(prefix string, path string, disambiguate bool) (string, error) {
+	canon := s.canonical(path)
+
+	candidate := prefix
+	for n := 2; ; n++ {
+		other, ok := s.prefixes[candidate]
+		if ok && other == canon || !ok && !s.binds[candidate] {
+			break
+		}
+		if !disambiguate && ok {
+			return "", fmt.Errorf("prefix collision: %s and %s both use prefix %s", s.names[other], path, prefix)
+		}
+		if !disambiguate {
+			return "", fmt.Errorf("prefix collision: %s uses prefix %s, the name of a prefixed local bind", path, prefix)
+		}
+		candidate = fmt.Sprintf("%s_%d", prefix, n)
+	}
+	s.prefixes[candidate] = canon
+
+	return candidate, nil
+}
+
+// Record the prefixed names of the binds of the file, prefixes claimed afterwards avoid them
+func (s *importState) addBinds(ctx *Context) {
+	for _, rep := range ctx.Replacements {
+		if rep.Kind == LocalBind {
+			s.binds[rep.NewValue] = true
+		}
+	}
+}
+
+// Get the prefixes claimed by files that a bind of a file with the prefix could be renamed
+// to, those starting with the prefix and the separator, in sorted order
+func (s *importState) prefixesUnder(prefix string) []string {
+	var under []string
+	for claimed := range s.prefixes {
+		if strings.HasPrefix(claimed, prefix) {
+			under = append(under, claimed)
+		}
+	}
+	slices.Sort(under)
+
+	return under
+}
+
+// Get the absolute path identifying a file regardless of how it was referenced
+func canonicalPath(path string) string {
+	if path == stdinName {
+		return path
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+
+	return abs
+}
+
+// Get the canonical path of the file, remembering the name it was first referenced by
+func (s *importState) canonical(path string) string {
+	canon := canonicalPath(path)
+	if _, ok := s.names[canon]; !ok {
+		s.names[canon] = path
+	}
+
+	return canon
+}
+
+// Get the canonical paths of every file referenced by the bundle, the inputs and the
+// files they import or embed, in sorted order
+func (s *importState) files() []string {
+	var files []string
+	for canon := range s.names {
+		if canon != stdinName {
+			files = append(files, canon)
+		}
+	}
+	slices.Sort(files)
+
+	return files
+}
+
+// Record that the file of ctx imports the file found at the given path
+func addDep(ctx *Context, foundAt string) {
+	from := ctx.imports.canonical(ctx.Filename)
+	to := ctx.imports.canonical(foundAt)
+
+	if !slices.Contains(ctx.imports.deps[from], to) {
+		ctx.imports.deps[from] = append(ctx.imports.deps[from], to)
+	}
+}
+
+// Bundle the imported file with its own prefix, reusing the result if it was already inlined
+func inlineImport(ctx *Context, importedPath string) (*inlinedFile, error) {
+	contents, foundAt, err := ctx.imports.importer.Import(ctx.Filename, importedPath)
+	if err != nil {
+		return nil, err
+	}
+
+	addDep(ctx, foundAt)
+
+	canon := ctx.imports.canonical(foundAt)
+	if file, ok := ctx.imports.inlined[canon]; ok {
+		return file, nil
+	}
+
+	// a file that is still being bundled can't be inlined into itself
+	if slices.ContainsFunc(ctx.importing, func(file string) bool { return canonicalPath(file) == canon }) {
+		return nil, fmt.Errorf("import cycle: %s", strings.Join(append(ctx.importing, foundAt), " -> "))
+	}
+
+	// the inputs are at depth 0 and each of their imports one level deeper
+	if depth, limit := len(ctx.importing), ctx.opts.maxDepth(); depth > limit {
+		return nil, fmt.Errorf("import depth exceeds the limit of %d: %s", limit, strings.Join(append(slices.Clone(ctx.importing), foundAt), " -> "))
+	}
+
+	prefix, err := ctx.opts.hash(foundAt)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix, err = ctx.imports.claimPrefix(prefix, foundAt, ctx.opts.namedPrefixes())
+	if err != nil {
+		return nil, err
+	}
+
+	importCtx := newContext(foundAt, []byte(contents.String()), prefix, ctx.opts, ctx.imports)
+	importCtx.importing = slices.Concat(ctx.importing, importCtx.importing)
+
+	err = Collect(importCtx)
+	if err == nil {
+		err = reportFailures(importCtx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	source, mappings, err := applyReplacements(importCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.imports.renames = append(ctx.imports.renames, renames(importCtx)...)
+	ctx.imports.edits = append(ctx.imports.edits, edits(importCtx)...)
+
+	file := &inlinedFile{prefix: importCtx.Prefix, source: source, mappings: mappings}
+	ctx.imports.inlined[canon] = file
+
+	return file, nil
+}
+
+// Get the files reachable from the roots through imports, each after the files it imports,
+// or with inlinedOnly through the imports that were inlined
+func importOrder(roots []string, imports *importState, inlinedOnly bool) ([]string, error) {
+	const (
+		visiting = iota + 1
+		visited
+	)
+
+	state := make(map[string]int)
+	var order, stack []string
+
+	var visit func(file string) error
+	visit = func(file string) error {
+		switch state[file] {
+		case visited:
+			return nil
+		case visiting:
+			var cycle []string
+			for _, f := range append(stack[slices.Index(stack, file):], file) {
+				cycle = append(cycle, imports.names[f])
+			}
+			return fmt.Errorf("import cycle: %s", strings.Join(cycle, " -> "))
+		}
+
+		state[file] = visiting
+		stack = append(stack, file)
+
+		for _, dep := range imports.deps[file] {
+			if _, ok := imports.inlined[dep]; inlinedOnly && !ok {
+				continue
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+
+		stack = stack[:len(stack)-1]
+		state[file] = visited
+		order = append(order, file)
+
+		return nil
+	}
+
+	for _, root := range roots {
+		if err := visit(root); err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
+
+// Sort the input sections so each comes after the inputs it imports, directly or
+// through other files, otherwise keeping the order the inputs were given in. Imports are
+// lazy so files left as imports may import each other in a cycle, the sections then keep
+// the input order. A cycle of inlined files already failed inlining them
+func sortSections(sections []*Context, imports *importState) []*Context {
+	var roots []string
+	for _, ctx := range sections {
+		roots = append(roots, imports.canonical(ctx.Filename))
+	}
+
+	order, err := importOrder(roots, imports, false)
+	if err != nil {
+		return sections
+	}
+
+	sorted := slices.Clone(sections)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return slices.Index(order, canonicalPath(sorted[i].Filename)) < slices.Index(order, canonicalPath(sorted[j].Filename))
+	})
+
+	return sorted
+}
+
+// Get the locals binding each file inlined into the section of ctx to its prefix,
+// ordered so that every file is bound after the files it imports, and their mappings
+func inlinedLocals(ctx *Context) ([]byte, []mapping, error) {
+	canon := ctx.imports.canonical(ctx.Filename)
+
+	order, err := importOrder([]string{canon}, ctx.imports, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var out []byte
+	var mappings []mapping
+	for _, file := range order {
+		inlined, ok := ctx.imports.inlined[file]
+		if !ok || file == canon {
+			continue
+		}
+
+		source := inlined.source
+		if n := ctx.opts.Indent; n > 0 {
+			if source, err = indentSource(ctx.imports.names[file], source, n); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		// keep the parens on their own lines so a trailing comment in the imported file can't swallow them
+		mappings = append(mappings, generated(len(out)))
+		out = append(out, "local "+inlined.prefix+" = (\n"...)
+		mappings = append(mappings, shift(inlined.mappings, len(out))...)
+		out = append(out, strings.TrimSuffix(string(source), "\n")...)
+		mappings = append(mappings, generated(len(out)))
+		out = append(out, "\n);\n"...)
+	}
+
+	return out, mappings, nil
+}
+
+// Indent the lines of the bundled source of an inlined file by n spaces for Options.Indent,
+// except blank lines and the lines continuing a string literal whose value would change
+func indentSource(filename string, source []byte, n int) ([]byte, error) {
+	node, _, err := parser.SnippetToRawAST(ast.DiagnosticFileName(filename), filename, string(source))
+	if err != nil {
+		return nil, fmt.Errorf("indenting %s: %w", filename, err)
+	}
+
+	inString := make(map[int]bool)
+	stringLines(node, inString)
+
+	indent := strings.Repeat(" ", n)
+	out := make([]byte, 0, len(source))
+	for i, line := range bytes.SplitAfter(source, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) > 0 && !inString[i+1] {
+			out = append(out, indent...)
+		}
+		out = append(out, line...)
+	}
+
+	return out, nil
+}
+
+// Record the lines under node that continue a multi-line string literal, text blocks
+// included since the indentation of their first line is stripped from the others
+func stringLines(node ast.Node, lines map[int]bool) {
+	if s, ok := node.(*ast.LiteralString); ok {
+		for line := s.Loc().Begin.Line + 1; line <= s.Loc().End.Line; line++ {
+			lines[line] = true
+		}
+	}
+
+	for _, child := range parser.Children(node) {
+		stringLines(child, lines)
+	}
+}
+
+// Collect a replacement for the span of an import expression, verifying it starts with the keyword
+func collectImportReplacement(ctx *Context, site importSite, newValue string) error {
+	beginOffset := ctx.offset(site.Begin.Line-1, site.Begin.Column-1)
+	endOffset := ctx.offset(site.End.Line-1, site.End.Column-1)
+
+	span := string(ctx.Source[beginOffset:endOffset])
+	if !strings.HasPrefix(span, string(site.Kind)) {
+		return fmt.Errorf("no match for %s %q at %v", site.Kind, site.File, &site.Begin)
+	}
+
+	ctx.Replacements = append(ctx.Replacements, Replacement{beginOffset, endOffset, newValue, span, site.Kind})
+
+	return nil
+}
+
+// An import or importstr expression found in a file
+type importSite struct {
+	// Import or ImportStr
+	Kind Kind
+	// the imported path as written
+	File string
+	// location of the whole expression
+	Begin, End ast.Location
+}
+
+// Find the import and importstr expressions under node in source order
+func collectImportSites(node ast.Node) []importSite {
+	var sites []importSite
+
+	switch n := node.(type) {
+	case *ast.Import:
+		sites = append(sites, importSite{Import, n.File.Value, n.Loc().Begin, n.Loc().End})
+	case *ast.ImportStr:
+		sites = append(sites, importSite{ImportStr, n.File.Value, n.Loc().Begin, n.Loc().End})
+	}
+
+	for _, child := range parser.Children(node) {
+		sites = append(sites, collectImportSites(child)...)
+	}
+
+	return sites
+}
+
+// Third pass, record the imports under node as dependencies of the file and, with
+// Options.InlineImports, collect the replacements inlining them
+func CollectImportReplacements(ctx *Context, node ast.Node) error {
+	return collectImports(ctx, collectImportSites(node))
+}
+
+// Record the imports found in the file as its dependencies and, with Options.InlineImports,
+// collect the replacements inlining them
+func collectImports(ctx *Context, sites []importSite) error {
+	for _, site := range sites {
+		switch site.Kind {
+		case Import:
+			if !ctx.opts.InlineImports {
+				// only record the dependency, an import that can't be resolved is left for jsonnet to report
+				if _, foundAt, err := ctx.imports.importer.Import(ctx.Filename, site.File); err == nil {
+					addDep(ctx, foundAt)
+				} else {
+					ctx.debugf("import %q at %v: %v", site.File, site.Begin, err)
+				}
+				continue
+			}
+
+			ctx.debugf("import %q at %v: inlining", site.File, &site.Begin)
+
+			file, err := inlineImport(ctx, site.File)
+			if err != nil {
+				return err
+			}
+
+			// the imported file is bound to its prefix once at the top of the section
+			if err := collectImportReplacement(ctx, site, file.prefix); err != nil {
+				return err
+			}
+		case ImportStr:
+			if !ctx.opts.InlineImports {
+				continue
+			}
+
+			ctx.debugf("importstr %q at %v: embedding", site.File, &site.Begin)
+
+			contents, foundAt, err := ctx.imports.importer.Import(ctx.Filename, site.File)
+			if err != nil {
+				return err
+			}
+			// the embedded file doesn't order the sections but is still part of the bundle
+			ctx.imports.canonical(foundAt)
+
+			// embed the file content as a single quoted string literal
+			newValue := "'" + parser.StringEscape(contents.String(), true) + "'"
+			if err := collectImportReplacement(ctx, site, newValue); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
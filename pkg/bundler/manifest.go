@@ -0,0 +1,60 @@
+package bundler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+)
+
+// Version of the manifest format
+const manifestVersion = 1
+
+// Manifest lists the files a bundle was built from, for auditing changes to its dependencies
+type Manifest struct {
+	Version int `json:"version"`
+	// the files sorted by path
+	Files []ManifestFile `json:"files"`
+}
+
+// A file read while bundling, an input or a file imported or embedded by one
+type ManifestFile struct {
+	// path of the file relative to the working directory, absolute if it's outside of it
+	Path string `json:"path"`
+	// prefix the file's locals were namespaced with, empty for files that weren't bundled
+	// such as imports left as is and files embedded with importstr
+	Prefix string `json:"prefix,omitempty"`
+	// hex encoded SHA-256 of the file content as read, a byte order mark included
+	SHA256 string `json:"sha256"`
+}
+
+// Build the manifest of the files read into the import state
+func newManifest(imports *importState) Manifest {
+	prefixes := make(map[string]string)
+	for prefix, canon := range imports.prefixes {
+		prefixes[canon] = prefix
+	}
+
+	wd, _ := os.Getwd()
+
+	m := Manifest{Version: manifestVersion, Files: []ManifestFile{}}
+	for _, canon := range imports.files() {
+		path := canon
+		if rel, err := filepath.Rel(wd, canon); err == nil && filepath.IsLocal(rel) {
+			path = filepath.ToSlash(rel)
+		}
+
+		// the inputs are served without their byte order mark, the imported files as read
+		file := ManifestFile{Path: path, Prefix: prefixes[canon]}
+		if sum, ok := imports.sums[canon]; ok {
+			file.SHA256 = hex.EncodeToString(sum[:])
+		} else if contents, ok := imports.importer.sources[canon]; ok {
+			sum := sha256.Sum256([]byte(contents.String()))
+			file.SHA256 = hex.EncodeToString(sum[:])
+		}
+
+		m.Files = append(m.Files, file)
+	}
+
+	return m
+}
@@ -0,0 +1,293 @@
+package bundler
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/google/go-jsonnet"
+	"github.com/nr8-io/jsonnet-bundler/pkg/parser"
+)
+
+// Strategy keeping the files of a bundle from interfering with each other
+type Strategy string
+
+const (
+	// prefix every local bind of a file and the variables referring to it, the default
+	StrategyRename Strategy = "rename"
+	// leave the files untouched and rely on each inlined file being bound to its prefix as
+	// a parenthesized expression, which scopes its locals, only imports are replaced
+	StrategyWrap Strategy = "wrap"
+	// prefix the locals like StrategyRename but bundle the files into an object with a
+	// field for each, named after its path, instead of one expression after another
+	StrategyObject Strategy = "object"
+)
+
+// How prefixes are derived from file names
+type PrefixStyle string
+
+const (
+	// a hash of the file path with the Hash algorithm, the default
+	PrefixStyleHash PrefixStyle = "hash"
+	// the file path without its extension, relative to HashRoot or the working directory,
+	// with the characters that can't be part of an identifier replaced with underscores
+	PrefixStylePath PrefixStyle = "path"
+)
+
+// Options configure a bundle, the zero value bundles like the command without flags
+// except that no header is prepended
+type Options struct {
+	// namespace used to prefix local binds instead of a hash of the file name, suffixed with
+	// the file's index when bundling multiple files, must be a valid Jsonnet identifier
+	Prefix string
+	// text between the prefix and the name of a bind, "_" when empty, must only contain
+	// letters, digits and underscores so prefixed names stay valid identifiers
+	PrefixSeparator string
+	// names of local binds that are never prefixed, together with the variables referring
+	// to them, each must be a valid Jsonnet identifier
+	ExcludeNames []string
+	// remove the comments before the first token of each file, such as a license repeated
+	// in every file, a leading "#!" line is kept
+	StripLeadingComments bool
+	// only prefix the binds of the locals at the root of each file, nested locals can't
+	// collide with other files and keep their names
+	OnlyExported bool
+	// bind the original name of each prefixed local to its prefixed name in the body of the
+	// local, e.g. `local helper = _a1b2c3_helper;`, so the bundled source stays readable
+	// and code evaluated inside it can still use the original names. Object locals aren't aliased
+	KeepAliases bool
+	// how the files are kept apart, StrategyRename when empty
+	Strategy Strategy
+	// prepend the auto-generated header comment
+	Header bool
+	// Go text/template for the header comment, receiving .Source, .Time and .Prefix,
+	// DefaultHeaderTemplate when empty
+	HeaderTemplate string
+	// text written for .Time in the header instead of the build time, such as a placeholder
+	// to compare bundles built at different times
+	HeaderTime string
+	// directory the file names in the header and section comments are relative to, the
+	// working directory when empty
+	HeaderRoot string
+	// number of leading line comments of the first file kept above the header, after a
+	// leading "#!" line which is always kept as the first line
+	PreserveLeading int
+	// how prefixes are derived from file names, PrefixStyleHash when empty
+	PrefixStyle PrefixStyle
+	// name of the hash algorithm used to derive prefixes from file names, one of
+	// HasherNames, "fnv" when empty
+	Hash string
+	// derive prefixes from file names instead of the Hash algorithm, each result must be
+	// a valid Jsonnet identifier
+	HashFunc func(filename string) string
+	// derive prefixes from file paths relative to this directory
+	HashRoot string
+	// additional library search directories, the first match wins
+	JPaths []string
+	// vendor directory of a project managed with the original jsonnet-bundler, searched
+	// after JPaths so that `github.com/org/repo/lib.libsonnet` resolves to the
+	// dependency installed under it
+	Vendor string
+	// directories every import and importstr must resolve into, the inputs themselves
+	// aren't restricted, imports are unrestricted when empty
+	ImportRoots []string
+	// format the bundled source with the go-jsonnet formatter, like `jsonnet fmt`
+	Format bool
+	// parse the bundled source again and fail if it isn't valid Jsonnet
+	Verify bool
+	// evaluate each bundled file and its original and fail unless both evaluate to the same JSON
+	CheckEval bool
+	// fail when a rename couldn't be applied instead of logging a warning, or when one
+	// of multiple files couldn't be parsed instead of skipping it
+	Strict bool
+	// fail when a local bind couldn't be renamed, only logging a warning for variables
+	StrictBinds bool
+	// top-level arguments passed as strings when evaluating for CheckEval, they don't
+	// affect the bundled source
+	TLAStr map[string]string
+	// top-level arguments passed as Jsonnet code when evaluating for CheckEval
+	TLACode map[string]string
+	// external variables read with std.extVar, as strings or as Jsonnet code, set on every
+	// VM used to parse and evaluate files, they don't affect the bundled source
+	ExtStr  map[string]string
+	ExtCode map[string]string
+	// cache of the collection results of unchanged files, nothing is cached when nil
+	Cache *Cache
+	// filled with the map relating positions in the bundle back to the original files when
+	// not nil, can't be combined with Format or Indent which move the text the map points into
+	SourceMap *SourceMap
+	// filled with the list of files the bundle was built from when not nil
+	Manifest *Manifest
+	// filled with the counts of what the bundle changed when not nil
+	Stats *Stats
+	// filled with every replacement made in the files of the bundle when not nil
+	Edits *Edits
+	// recursively replace imports with the bundled source of the imported files
+	InlineImports bool
+	// how deep imports are inlined recursively before failing, in case of a runaway import
+	// graph, DefaultMaxDepth when zero
+	MaxDepth int
+	// indent the source of each inlined file by this many spaces inside the local it is
+	// bound to, the original indentation is kept when zero
+	Indent int
+	// end the bundle with exactly one newline instead of however the last file ends
+	NormalizeNewline bool
+	// print the replacements that would be made to stderr instead of bundling
+	DryRun bool
+	// log a warning for each prefixed local bind that no variable refers to, dead code or
+	// a variable the variable pass missed
+	WarnUnused bool
+	// log how each local bind and variable is matched
+	Verbose bool
+}
+
+// Depth of recursive import inlining used when MaxDepth is zero, far deeper than
+// the import graphs of actual projects
+const DefaultMaxDepth = 100
+
+// Check that the separator keeps prefixed names valid identifiers, the empty
+// separator selects the default
+func ValidPrefixSeparator(sep string) bool {
+	return parser.IsValidIdentifier("_" + sep)
+}
+
+// Get the limit on the depth of recursive import inlining
+func (o *Options) maxDepth() int {
+	if o.MaxDepth == 0 {
+		return DefaultMaxDepth
+	}
+
+	return o.MaxDepth
+}
+
+// Get the text between the prefix and the names of the binds
+func (o *Options) prefixSeparator() string {
+	if o.PrefixSeparator == "" {
+		return "_"
+	}
+
+	return o.PrefixSeparator
+}
+
+// Check that the options are usable before bundling anything
+func (o *Options) validate() error {
+	if !ValidPrefixSeparator(o.PrefixSeparator) {
+		return fmt.Errorf("invalid prefix separator %q: must only contain letters, digits and underscores", o.PrefixSeparator)
+	}
+
+	if o.Prefix != "" && !parser.IsValidIdentifier(o.Prefix) {
+		return fmt.Errorf("invalid prefix %q: must be a valid Jsonnet identifier", o.Prefix)
+	}
+
+	for _, name := range o.ExcludeNames {
+		if !parser.IsValidIdentifier(name) {
+			return fmt.Errorf("invalid excluded name %q: must be a valid Jsonnet identifier", name)
+		}
+	}
+
+	if o.Strategy != "" && !slices.Contains([]Strategy{StrategyRename, StrategyWrap, StrategyObject}, o.Strategy) {
+		return fmt.Errorf("invalid strategy %q: must be %s, %s or %s", o.Strategy, StrategyRename, StrategyWrap, StrategyObject)
+	}
+
+	if o.PrefixStyle != "" && !slices.Contains([]PrefixStyle{PrefixStyleHash, PrefixStylePath}, o.PrefixStyle) {
+		return fmt.Errorf("invalid prefix style %q: must be %s or %s", o.PrefixStyle, PrefixStyleHash, PrefixStylePath)
+	}
+
+	if o.HashFunc == nil && o.Hash != "" && !slices.Contains(HasherNames(), o.Hash) {
+		return fmt.Errorf("invalid hash %q: must be one of %s", o.Hash, strings.Join(HasherNames(), ", "))
+	}
+
+	if o.MaxDepth < 0 {
+		return fmt.Errorf("invalid max depth %d: must not be negative", o.MaxDepth)
+	}
+
+	if o.Indent < 0 {
+		return fmt.Errorf("invalid indent %d: must not be negative", o.Indent)
+	}
+
+	if o.SourceMap != nil && (o.Format || o.Indent > 0) {
+		return fmt.Errorf("a source map can't be built for a formatted or re-indented bundle")
+	}
+
+	return nil
+}
+
+// Create the importer used to resolve imports, searching the directory of the
+// importing file first, then each of JPaths in the order given and then Vendor,
+// restricted to ImportRoots if any
+func (o *Options) importer() jsonnet.Importer {
+	// FileImporter searches its JPaths from last to first, reverse them so the first match wins
+	paths := slices.Clone(o.JPaths)
+	if o.Vendor != "" {
+		paths = append(paths, o.Vendor)
+	}
+	slices.Reverse(paths)
+
+	var importer jsonnet.Importer = &jsonnet.FileImporter{JPaths: paths}
+	if len(o.ImportRoots) > 0 {
+		importer = newRootedImporter(importer, o.ImportRoots)
+	}
+
+	return importer
+}
+
+// Create a VM with the external variables and top-level arguments set, see vmPool
+func (o *Options) newVM() *jsonnet.VM {
+	vm := jsonnet.MakeVM()
+
+	for key, value := range o.ExtStr {
+		vm.ExtVar(key, value)
+	}
+	for key, value := range o.ExtCode {
+		vm.ExtCode(key, value)
+	}
+	for key, value := range o.TLAStr {
+		vm.TLAVar(key, value)
+	}
+	for key, value := range o.TLACode {
+		vm.TLACode(key, value)
+	}
+
+	return vm
+}
+
+// Get the name of the file written in the header and section comments, relative to
+// HeaderRoot or the working directory so it doesn't leak machine specific paths, or
+// the name as given when no relative path can be computed
+func (o *Options) headerPath(filename string) string {
+	if filename == stdinName {
+		return filename
+	}
+
+	root := o.HeaderRoot
+	if root == "" {
+		root = "."
+	}
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return filename
+	}
+
+	rel, err := filepath.Rel(root, canonicalPath(filename))
+	if err != nil {
+		return filename
+	}
+
+	return filepath.ToSlash(rel)
+}
+
+// Get the prefix for the i-th of n input files, Prefix if given (suffixed with
+// the index when bundling multiple files) or a hash of the file name
+func (o *Options) filePrefix(source string, i int, n int) (string, error) {
+	if o.Prefix == "" {
+		return o.hash(source)
+	}
+
+	if n > 1 {
+		return fmt.Sprintf("%s%d", o.Prefix, i), nil
+	}
+
+	return o.Prefix, nil
+}
@@ -0,0 +1,30 @@
+package bundler
+
+import (
+	"sync"
+
+	"github.com/google/go-jsonnet"
+)
+
+// Pool of the VMs parsing and evaluating the files of a bundle, all configured the same
+// from the options so that any worker can borrow one as a VM isn't safe for concurrent use
+type vmPool struct {
+	pool sync.Pool
+}
+
+func newVMPool(opts *Options) *vmPool {
+	return &vmPool{sync.Pool{New: func() any { return opts.newVM() }}}
+}
+
+// Borrow a VM importing with the importer, which also drops the imports its previous
+// borrower cached, return it with put once done
+func (p *vmPool) get(importer jsonnet.Importer) *jsonnet.VM {
+	vm := p.pool.Get().(*jsonnet.VM)
+	vm.Importer(importer)
+
+	return vm
+}
+
+func (p *vmPool) put(vm *jsonnet.VM) {
+	p.pool.Put(vm)
+}
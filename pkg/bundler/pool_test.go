@@ -0,0 +1,36 @@
+package bundler
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// Run with -race, the inputs are parsed by concurrent workers borrowing VMs from the pool
+func TestVMPool(t *testing.T) {
+	// enough workers to share the pool even on a single CPU
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(max(4, runtime.NumCPU())))
+
+	files := make(map[string]string)
+	var inputs []string
+	for i := range 200 {
+		name := fmt.Sprintf("f%d.libsonnet", i)
+		files[name] = fmt.Sprintf("local v = std.extVar('env') + '-%d';\n{ v: v }\n", i)
+		inputs = append(inputs, name)
+	}
+	dir := writeFiles(t, files)
+	for i, input := range inputs {
+		inputs[i] = filepath.Join(dir, input)
+	}
+
+	// Strict evaluates every file, which fails on a pooled VM missing the external variable
+	out, err := BundleFiles(inputs, Options{ExtStr: map[string]string{"env": "test"}, Strict: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(out), "std.extVar('env') + '-"); n != len(inputs) {
+		t.Errorf("bundle has %d of the %d files", n, len(inputs))
+	}
+}
@@ -0,0 +1,97 @@
+package bundler
+
+import (
+	"github.com/google/go-jsonnet/ast"
+)
+
+// Version of the source map format
+const sourceMapVersion = 1
+
+// SourceMap relates positions in a bundle back to the original files. Each segment starts
+// where the previous one ends, a position inside a segment maps to the original position at
+// the same distance from the segment's start, except that a replaced name maps to its start
+type SourceMap struct {
+	Version int `json:"version"`
+	// the original files, referenced by index from the segments
+	Sources []string `json:"sources"`
+	// segments in bundle order
+	Segments []Segment `json:"segments"`
+}
+
+// A span of the bundle copied from an original file, or generated by the bundler
+type Segment struct {
+	// byte offset and 1-based line and column in the bundle where the segment starts
+	Offset int `json:"offset"`
+	Line   int `json:"line"`
+	Column int `json:"column"`
+	// index of the original file in Sources, -1 for text generated by the bundler such as
+	// the header, section comments and the locals binding inlined files
+	Source int `json:"source"`
+	// byte offset and 1-based line and column in the original file, zero for generated text
+	OriginalOffset int `json:"originalOffset"`
+	OriginalLine   int `json:"originalLine"`
+	OriginalColumn int `json:"originalColumn"`
+}
+
+// Start of a span of bundled text and where it comes from, built while bundling with
+// offsets relative to the text being built and shifted as it is placed in the bundle
+type mapping struct {
+	// byte offset of the span in the bundled text
+	offset int
+	// the original file, empty for generated text
+	file string
+	// byte offset and location of the span in the original file
+	origOffset int
+	loc        ast.Location
+}
+
+// Map the bundled text at offset to the source of the context at origOffset
+func (ctx *Context) mapping(offset int, origOffset int) mapping {
+	return mapping{offset, ctx.Filename, origOffset, ctx.location(origOffset)}
+}
+
+// Map the bundled text at offset as generated by the bundler
+func generated(offset int) mapping {
+	return mapping{offset: offset}
+}
+
+// Move the mappings of text placed at offset in the bundle
+func shift(mappings []mapping, offset int) []mapping {
+	out := make([]mapping, len(mappings))
+	for i, m := range mappings {
+		m.offset += offset
+		out[i] = m
+	}
+
+	return out
+}
+
+// Build the source map of the bundle from its mappings
+func newSourceMap(bundle []byte, mappings []mapping) SourceMap {
+	lineOffsets := buildLineOffsets(bundle)
+	sources := make(map[string]int)
+
+	sm := SourceMap{Version: sourceMapVersion, Sources: []string{}, Segments: []Segment{}}
+	for _, m := range mappings {
+		line, col := offsetToLineCol(lineOffsets, m.offset)
+		seg := Segment{Offset: m.offset, Line: line, Column: col, Source: -1}
+
+		if m.file != "" {
+			i, ok := sources[m.file]
+			if !ok {
+				i = len(sm.Sources)
+				sources[m.file] = i
+				sm.Sources = append(sm.Sources, m.file)
+			}
+
+			seg.Source = i
+			seg.OriginalOffset = m.origOffset
+			seg.OriginalLine = m.loc.Line
+			seg.OriginalColumn = m.loc.Column
+		}
+
+		sm.Segments = append(sm.Segments, seg)
+	}
+
+	return sm
+}
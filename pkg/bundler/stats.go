@@ -0,0 +1,27 @@
+package bundler
+
+// Stats summarize what a bundle changed
+type Stats struct {
+	// number of files bundled, the inputs and the files inlined into them
+	Files int
+	// number of local binds and of variables renamed
+	LocalBinds int
+	Vars       int
+	// size of the bundle in bytes
+	Bytes int
+}
+
+// Count the renames of a bundle of files
+func newStats(files int, renames []Rename, bundle []byte) Stats {
+	stats := Stats{Files: files, Bytes: len(bundle)}
+	for _, r := range renames {
+		switch r.Kind {
+		case LocalBind:
+			stats.LocalBinds++
+		case VarUsage:
+			stats.Vars++
+		}
+	}
+
+	return stats
+}
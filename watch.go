@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Time to wait for more changes before rebuilding, a single save often emits several events
+const watchDebounce = 100 * time.Millisecond
+
+// Rebuild the bundle whenever one of the files it depends on changes, or a file added to or
+// removed from a directory the inputs are found in changes the inputs, until the watcher
+// fails or done is closed. The inputs as given are resolved again for each rebuild, see
+// resolveInputs, starting from the inputs already resolved
+func watch(given []string, inputs []string, output string, done <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// directories are watched rather than files since editors often save by replacing the file
+	files := make(map[string]bool)
+	dirs := make(map[string]bool)
+	// the directories of the --dir tree and of the glob patterns
+	sources := make(map[string]bool)
+
+	// Resolve the inputs again, reporting whether they changed. They are kept when that
+	// fails, e.g. while the only file matching a pattern is being replaced
+	resolve := func() bool {
+		resolved, walked, err := resolveInputs(given)
+		if err != nil {
+			errorLog.Printf("resolving inputs: %v", err)
+			return false
+		}
+
+		// the output may be written into the tree the inputs are found in
+		resolved = slices.DeleteFunc(resolved, func(input string) bool { return sameFile(input, output) })
+
+		clear(sources)
+		for _, dir := range walked {
+			sources[filepath.Clean(dir)] = true
+		}
+
+		changed := !slices.Equal(resolved, inputs)
+		inputs = resolved
+
+		return changed
+	}
+
+	// Watch the directories of the files and the sources, and only those
+	sync := func() {
+		needed := make(map[string]bool)
+		for file := range files {
+			needed[filepath.Dir(file)] = true
+		}
+		for dir := range sources {
+			needed[dir] = true
+		}
+
+		for dir := range needed {
+			if dirs[dir] {
+				continue
+			}
+			if err := watcher.Add(dir); err != nil {
+				log.Printf("watching %s: %v", dir, err)
+				continue
+			}
+			dirs[dir] = true
+		}
+
+		for dir := range dirs {
+			if !needed[dir] {
+				watcher.Remove(dir)
+				delete(dirs, dir)
+			}
+		}
+	}
+
+	update := func(deps []string, err error) {
+		// a failed build may not have discovered every file, keep watching the previous
+		// ones so that undoing the change that broke the build rebuilds it
+		if err == nil {
+			clear(files)
+		}
+		for _, file := range deps {
+			files[file] = true
+		}
+
+		sync()
+	}
+
+	resolve()
+	update(rebuild(inputs, output))
+
+	var debounce <-chan time.Time
+	changed := false
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+
+			name := filepath.Clean(event.Name)
+			switch {
+			case event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Write):
+				continue
+			case files[name]:
+				changed = true
+			case !sources[filepath.Dir(name)] || event.Op&(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0:
+				continue
+			}
+			debounce = time.After(watchDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			return err
+		case <-debounce:
+			debounce = nil
+
+			// a file added or removed next to the inputs only rebuilds when it changes them,
+			// so writing the output or its source map there doesn't rebuild again
+			if resolve() || changed {
+				update(rebuild(inputs, output))
+			} else {
+				sync()
+			}
+			changed = false
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// Build the bundle and print a status line, returning the files the bundle depends on
+func rebuild(inputs []string, output string) ([]string, error) {
+	start := time.Now()
+
+	files, err := build(inputs, output)
+	if err != nil {
+		errorLog.Printf("build failed: %v", err)
+		return files, err
+	}
+
+	log.Printf("bundled %d files into %s in %v", len(files), output, time.Since(start).Round(time.Millisecond))
+
+	return files, nil
+}
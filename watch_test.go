@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Wait until the file contains the text, failing the test after a few seconds
+func waitForContent(t *testing.T, path string, text string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := os.ReadFile(path)
+		if strings.Contains(string(data), text) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s doesn't contain %q:\n%s", path, text, data)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestWatchNewInput(t *testing.T) {
+	tree := t.TempDir()
+	write := func(name string, content string) {
+		path := filepath.Join(tree, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.libsonnet", "{ a: 1 }\n")
+
+	// the output is written into the tree, it must not become an input
+	output := filepath.Join(tree, "bundle.libsonnet")
+
+	defer func(d string) { dir = d }(dir)
+	dir = tree
+
+	inputs, _, err := resolveInputs(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() { errs <- watch(nil, inputs, output, done) }()
+
+	waitForContent(t, output, "{ a: 1 }")
+
+	write("b.libsonnet", "{ b: 2 }\n")
+	waitForContent(t, output, "{ b: 2 }")
+
+	// a directory created in the tree is watched as well
+	if err := os.Mkdir(filepath.Join(tree, "lib"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(4 * watchDebounce)
+	write("lib/c.libsonnet", "{ c: 3 }\n")
+	waitForContent(t, output, "{ c: 3 }")
+
+	close(done)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "bundle.libsonnet") {
+		t.Errorf("the output was bundled as an input:\n%s", data)
+	}
+}